@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+
+	"github.com/bitrise-io/go-utils/log"
+	"github.com/bitrise-steplib/bitrise-step-build-router-start/bitrise"
+)
+
+// The scopes of aborting the builds when a build fails.
+const (
+	abortScopeAll   = "all"
+	abortScopeStage = "stage"
+	abortScopeNone  = "none"
+)
+
+var abortScopes = []string{abortScopeAll, abortScopeStage, abortScopeNone}
+
+const defaultAbortReasonTemplate = "Abort on Fail - Build [{{ .BuildURL }}] {{ .FailReason }}\nAuto aborted by parent build"
+
+// abortReasonData is the data of the abort reason template.
+type abortReasonData struct {
+	// Workflow, BuildNumber and BuildURL identify the failed build.
+	Workflow    string
+	BuildNumber int64
+	BuildURL    string
+	// FailReason is failed or aborted.
+	FailReason string
+	// AbortedWorkflow is the workflow of the aborted build.
+	AbortedWorkflow   string
+	ParentBuildNumber string
+	ParentBuildURL    string
+}
+
+func parseAbortReasonTemplate(text string) (*template.Template, error) {
+	if strings.TrimSpace(text) == "" {
+		text = defaultAbortReasonTemplate
+	}
+	return template.New("abort_reason").Option("missingkey=error").Parse(text)
+}
+
+func renderAbortReason(tmpl *template.Template, data abortReasonData) (string, error) {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("failed to execute abort reason template: %s", err)
+	}
+	return buf.String(), nil
+}
+
+// abortOptions returns the abort settings of the abort_with_success and abort_skip_notifications inputs.
+func (r *router) abortOptions(reason string) bitrise.AbortOptions {
+	return bitrise.AbortOptions{
+		Reason:            reason,
+		WithSuccess:       r.cfg.AbortWithSuccess == "yes",
+		SkipNotifications: r.cfg.AbortSkipNotifications != "no",
+	}
+}
+
+// abortCandidates returns the slugs of the builds in the abort scope of the failed build, without the failed build.
+// The given build slugs are candidates even if they are not routed builds.
+func (r *router) abortCandidates(failed bitrise.Build, buildSlugs []string) []string {
+	scope := r.cfg.AbortScope
+	if scope == "" {
+		scope = abortScopeAll
+	}
+	if scope == abortScopeNone {
+		return nil
+	}
+
+	failedStage := 0
+	if routed := r.state.findBuild(failed.Slug); routed != nil {
+		failedStage = routed.Stage
+	}
+
+	slugs := append([]string{}, buildSlugs...)
+	for _, slug := range r.state.buildSlugs() {
+		if !contains(slugs, slug) {
+			slugs = append(slugs, slug)
+		}
+	}
+
+	var candidates []string
+	for _, slug := range slugs {
+		if slug == failed.Slug {
+			continue
+		}
+		routed := r.state.findBuild(slug)
+		if routed != nil && routed.Status.IsTerminal() {
+			continue
+		}
+		if scope == abortScopeStage && routed != nil && routed.Stage != failedStage {
+			continue
+		}
+		candidates = append(candidates, slug)
+	}
+	return candidates
+}
+
+// abortOnFail aborts the running builds in the abort scope of the failed build.
+func (r *router) abortOnFail(failed bitrise.Build, buildSlugs []string) {
+	candidates := r.abortCandidates(failed, buildSlugs)
+	if len(candidates) == 0 {
+		return
+	}
+
+	tmpl := r.abortReason
+	if tmpl == nil {
+		var err error
+		if tmpl, err = parseAbortReasonTemplate(""); err != nil {
+			log.Warnf("failed to parse abort reason template: %s", err)
+			return
+		}
+	}
+
+	failReason := "failed"
+	if failed.IsAborted() {
+		failReason = "aborted"
+	}
+
+	for _, buildSlug := range candidates {
+		// The status of the build may have changed since it was last checked, finished builds can't be aborted.
+		build, err := r.app.GetBuild(buildSlug)
+		if err != nil {
+			log.Warnf("failed to get build (%s), error: %s", buildSlug, err)
+		} else if build.Status.IsTerminal() {
+			log.Debugf("Build %s already finished, not aborting it", buildSlug)
+			continue
+		}
+
+		abortedWorkflow := build.TriggeredWorkflow
+		if routed := r.state.findBuild(buildSlug); routed != nil {
+			abortedWorkflow = routed.Workflow
+		}
+
+		abortReason, err := renderAbortReason(tmpl, abortReasonData{
+			Workflow:          failed.TriggeredWorkflow,
+			BuildNumber:       failed.BuildNumber,
+			BuildURL:          r.buildURL(failed.Slug),
+			FailReason:        failReason,
+			AbortedWorkflow:   abortedWorkflow,
+			ParentBuildNumber: r.cfg.BuildNumber,
+			ParentBuildURL:    r.parentBuildURL(),
+		})
+		if err != nil {
+			log.Warnf("%s", err)
+			continue
+		}
+
+		if err := r.app.AbortBuildWithOptions(buildSlug, r.abortOptions(abortReason)); err != nil {
+			log.Warnf("failed to abort build, error: %s", err)
+			continue
+		}
+		log.Donef("Build %s aborted due to associated build failure", buildSlug)
+
+		if aborted := r.state.findBuild(buildSlug); aborted != nil {
+			r.events.publish(newEvent(eventAborted, *aborted, abortReason))
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"testing"
+
+	"github.com/bitrise-steplib/bitrise-step-build-router-start/bitrise"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_renderAbortReason(t *testing.T) {
+	tmpl, err := parseAbortReasonTemplate("")
+	require.NoError(t, err)
+
+	reason, err := renderAbortReason(tmpl, abortReasonData{BuildURL: "https://app.bitrise.io/build/slug", FailReason: "failed"})
+	require.NoError(t, err)
+	require.Equal(t, "Abort on Fail - Build [https://app.bitrise.io/build/slug] failed\nAuto aborted by parent build", reason)
+
+	tmpl, err = parseAbortReasonTemplate("{{ .Workflow }} #{{ .BuildNumber }} {{ .FailReason }}, aborted {{ .AbortedWorkflow }} of #{{ .ParentBuildNumber }}")
+	require.NoError(t, err)
+	reason, err = renderAbortReason(tmpl, abortReasonData{Workflow: "ui-test", BuildNumber: 12, FailReason: "aborted", AbortedWorkflow: "lint", ParentBuildNumber: "10"})
+	require.NoError(t, err)
+	require.Equal(t, "ui-test #12 aborted, aborted lint of #10", reason)
+
+	_, err = parseAbortReasonTemplate("{{ .Workflow")
+	require.Error(t, err)
+}
+
+func Test_abortOnFail(t *testing.T) {
+	builds := map[string]string{
+		"failed":        `{"slug": "failed", "status": 2, "build_number": 12, "triggered_workflow": "ui-test"}`,
+		"running":       `{"slug": "running", "status": 0, "triggered_workflow": "lint"}`,
+		"just-finished": `{"slug": "just-finished", "status": 1, "triggered_workflow": "unit"}`,
+		"other-stage":   `{"slug": "other-stage", "status": 0, "triggered_workflow": "deploy"}`,
+	}
+
+	tests := []struct {
+		name        string
+		scope       string
+		wantAborted []string
+	}{
+		{name: "all", scope: abortScopeAll, wantAborted: []string{"running", "other-stage"}},
+		{name: "default", scope: "", wantAborted: []string{"running", "other-stage"}},
+		{name: "stage", scope: abortScopeStage, wantAborted: []string{"running"}},
+		{name: "none", scope: abortScopeNone},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var aborted []string
+			var options []map[string]interface{}
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == http.MethodPost {
+					body, err := ioutil.ReadAll(r.Body)
+					require.NoError(t, err)
+					var params map[string]interface{}
+					require.NoError(t, json.Unmarshal(body, &params))
+
+					aborted = append(aborted, path.Base(path.Dir(r.URL.Path)))
+					options = append(options, params)
+					fmt.Fprint(w, `{"status": "ok"}`)
+					return
+				}
+				fmt.Fprintf(w, `{"data": %s}`, builds[path.Base(r.URL.Path)])
+			}))
+			defer server.Close()
+
+			sink := &recordingSink{}
+			r := router{
+				app:    bitrise.App{BaseURL: server.URL, Slug: "app", AccessToken: "token", IsDebugRetryTimings: true},
+				cfg:    Config{BuildSlug: "parent", BuildNumber: "10", AbortScope: tt.scope, AbortWithSuccess: "yes", AbortSkipNotifications: "no"},
+				events: &eventBus{},
+				state: &routerState{Builds: []*routedBuild{
+					{Workflow: "ui-test", Slug: "failed", Stage: 1},
+					{Workflow: "lint", Slug: "running", Stage: 1},
+					{Workflow: "unit", Slug: "just-finished", Stage: 1},
+					{Workflow: "build", Slug: "finished", Stage: 1, Status: bitrise.BuildStatusSuccessful},
+					{Workflow: "deploy", Slug: "other-stage", Stage: 2},
+				}},
+			}
+			r.events.subscribe(sink)
+
+			var failed bitrise.Build
+			require.NoError(t, json.Unmarshal([]byte(builds["failed"]), &failed))
+			r.abortOnFail(failed, []string{"failed", "running", "just-finished", "finished"})
+
+			require.Equal(t, tt.wantAborted, aborted)
+			require.Len(t, sink.events, len(tt.wantAborted))
+			for _, params := range options {
+				require.Equal(t, "Abort on Fail - Build [https://app.bitrise.io/build/failed] failed\nAuto aborted by parent build", params["abort_reason"])
+				require.Equal(t, true, params["abort_with_success"])
+				require.Equal(t, false, params["skip_notifications"])
+			}
+		})
+	}
+}
@@ -1,13 +1,13 @@
 package bitrise
 
 import (
-	"bytes"
 	"encoding/json"
 	"fmt"
-	"io"
-	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -15,39 +15,50 @@ import (
 	"github.com/hashicorp/go-retryablehttp"
 )
 
+// SourceBuildNumberEnvKey is the key of the env, injected into every started build, holding the parent build number.
+const SourceBuildNumberEnvKey = "SOURCE_BITRISE_BUILD_NUMBER"
+
+// SourceBuildSlugEnvKey is the key of the env, shared with every started build, holding the parent build slug.
+// It identifies the builds started by the Step, e.g. to cancel the builds of superseded parent builds.
+const SourceBuildSlugEnvKey = "SOURCE_BITRISE_BUILD_SLUG"
+
 // Build ...
 type Build struct {
 	Slug                string          `json:"slug"`
-	Status              int             `json:"status"`
+	Status              BuildStatus     `json:"status"`
 	StatusText          string          `json:"status_text"`
 	BuildNumber         int64           `json:"build_number"`
 	TriggeredWorkflow   string          `json:"triggered_workflow"`
+	TriggeredAt         *time.Time      `json:"triggered_at"`
+	StartedOnWorkerAt   *time.Time      `json:"started_on_worker_at"`
+	FinishedAt          *time.Time      `json:"finished_at"`
+	CommitHash          string          `json:"commit_hash"`
 	OriginalBuildParams json.RawMessage `json:"original_build_params"`
 }
 
 // IsRunning ...
 func (build Build) IsRunning() bool {
-	return build.Status == 0
+	return build.Status == BuildStatusRunning
 }
 
 // IsSuccessful ...
 func (build Build) IsSuccessful() bool {
-	return build.Status == 1
+	return build.Status == BuildStatusSuccessful
 }
 
 // IsFailed ...
 func (build Build) IsFailed() bool {
-	return build.Status == 2
+	return build.Status == BuildStatusFailed
 }
 
 // IsAborted ...
 func (build Build) IsAborted() bool {
-	return build.Status == 3
+	return build.Status == BuildStatusAborted
 }
 
 // IsAbortedWithSuccess ...
 func (build Build) IsAbortedWithSuccess() bool {
-	return build.Status == 4
+	return build.Status == BuildStatusAbortedWithSuccess
 }
 
 type buildResponse struct {
@@ -82,11 +93,13 @@ type buildAbortParams struct {
 // BuildArtifactsResponse ...
 type BuildArtifactsResponse struct {
 	ArtifactSlugs []BuildArtifactSlug `json:"data"`
+	Paging        Paging              `json:"paging"`
 }
 
 // BuildArtifactSlug ...
 type BuildArtifactSlug struct {
 	ArtifactSlug string `json:"slug"`
+	Title        string `json:"title"`
 }
 
 // BuildArtifactResponse ...
@@ -110,12 +123,18 @@ type Environment struct {
 type App struct {
 	BaseURL, Slug, AccessToken string
 	IsDebugRetryTimings        bool
+	// HTTPClient sends the requests, the default client is used if nil.
+	HTTPClient *http.Client
+	// Client is the shared core of the API requests, a new Client is used for each request if nil.
+	Client *Client
+	// PollInterval is the time between two status checks of the builds waited for, defaults to 3 seconds.
+	PollInterval time.Duration
 }
 
 // NewAppWithDefaultURL returns a Bitrise client with the default URl
 func NewAppWithDefaultURL(slug, accessToken string) App {
 	return App{
-		BaseURL:     "https://api.bitrise.io",
+		BaseURL:     DefaultBaseURL,
 		Slug:        slug,
 		AccessToken: accessToken,
 	}
@@ -147,7 +166,7 @@ func (*RetryLogAdaptor) Printf(fmtStr string, vars ...interface{}) {
 func NewRetryableClient(isDebugRetryTimings bool) *retryablehttp.Client {
 	client := retryablehttp.NewClient()
 	client.CheckRetry = retryablehttp.DefaultRetryPolicy
-	client.Backoff = retryablehttp.DefaultBackoff
+	client.Backoff = retryAfterBackoff
 	client.Logger = &RetryLogAdaptor{}
 	client.ErrorHandler = retryablehttp.PassthroughErrorHandler
 	if !isDebugRetryTimings {
@@ -164,59 +183,26 @@ func NewRetryableClient(isDebugRetryTimings bool) *retryablehttp.Client {
 }
 
 // GetBuild ...
-func (app App) GetBuild(buildSlug string) (build Build, err error) {
-	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/v0.1/apps/%s/builds/%s", app.BaseURL, app.Slug, buildSlug), nil)
-	if err != nil {
-		return Build{}, err
-	}
-
-	req.Header.Add("Authorization", "token "+app.AccessToken)
-
-	retryReq, err := retryablehttp.FromRequest(req)
-	if err != nil {
-		return Build{}, fmt.Errorf("failed to create retryable request: %s", err)
-	}
-
-	client := NewRetryableClient(app.IsDebugRetryTimings)
-
-	resp, err := client.Do(retryReq)
-	if err != nil {
-		return Build{}, err
-	}
-
-	defer func() {
-		if cerr := resp.Body.Close(); cerr != nil && err == nil {
-			err = cerr
-		}
-	}()
-
-	respBody, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
+func (app App) GetBuild(buildSlug string) (Build, error) {
+	var response buildResponse
+	if err := app.getJSON("GET /builds/{build_slug}", app.appURL("/builds/"+buildSlug), &response); err != nil {
 		return Build{}, err
 	}
-
-	if resp.StatusCode < 200 || resp.StatusCode > 299 {
-		return Build{}, fmt.Errorf("failed to get response, statuscode: %d, body: %s", resp.StatusCode, respBody)
-	}
-
-	var buildResponse buildResponse
-	if err := json.Unmarshal(respBody, &buildResponse); err != nil {
-		return Build{}, fmt.Errorf("failed to decode response, body: %s, error: %s", respBody, err)
-	}
-	return buildResponse.Data, nil
+	return response.Data, nil
 }
 
-// StartBuild ...
-func (app App) StartBuild(workflow string, buildParams json.RawMessage, buildNumber string, environments []Environment) (startResponse StartResponse, err error) {
+// StartBuild starts a build of the workflow.
+// Rate limited requests are not retried, a *RateLimitError is returned instead, so the caller can pace the retries.
+func (app App) StartBuild(workflow string, buildParams json.RawMessage, buildNumber string, environments []Environment) (StartResponse, error) {
 	var params map[string]interface{}
 	if err := json.Unmarshal(buildParams, &params); err != nil {
-		return StartResponse{}, err
+		return StartResponse{}, fmt.Errorf("failed to parse build params: %s", err)
 	}
 	params["workflow_id"] = workflow
 	params["skip_git_status_report"] = true
 
 	sourceBuildNumber := Environment{
-		MappedTo: "SOURCE_BITRISE_BUILD_NUMBER",
+		MappedTo: SourceBuildNumberEnvKey,
 		Value:    buildNumber,
 	}
 
@@ -225,258 +211,187 @@ func (app App) StartBuild(workflow string, buildParams json.RawMessage, buildNum
 
 	b, err := json.Marshal(params)
 	if err != nil {
-		return StartResponse{}, nil
+		return StartResponse{}, fmt.Errorf("failed to marshal build params: %s", err)
 	}
 
-	rm := startRequest{HookInfo: hookInfo{Type: "bitrise"}, BuildParams: b}
-	b, err = json.Marshal(rm)
+	req, err := newJSONRequest(http.MethodPost, app.appURL("/builds"), startRequest{HookInfo: hookInfo{Type: "bitrise"}, BuildParams: b})
 	if err != nil {
-		return StartResponse{}, nil
-	}
-
-	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/v0.1/apps/%s/builds", app.BaseURL, app.Slug), bytes.NewReader(b))
-	if err != nil {
-		return StartResponse{}, nil
-	}
-	req.Header.Add("Authorization", "token "+app.AccessToken)
-	req.Header.Add("Content-Type", "application/json")
-
-	retryReq, err := retryablehttp.FromRequest(req)
-	if err != nil {
-		return StartResponse{}, fmt.Errorf("failed to create retryable request: %s", err)
-	}
-
-	retryClient := NewRetryableClient(app.IsDebugRetryTimings)
-
-	resp, err := retryClient.Do(retryReq)
-	if err != nil {
-		return StartResponse{}, nil
-	}
-
-	defer func() {
-		if cerr := resp.Body.Close(); cerr != nil && err == nil {
-			err = cerr
-		}
-	}()
-
-	respBody, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return StartResponse{}, nil
-	}
-
-	if resp.StatusCode < 200 || resp.StatusCode > 299 {
-		return StartResponse{}, fmt.Errorf("failed to get response, statuscode: %d, body: %s", resp.StatusCode, respBody)
+		return StartResponse{}, err
 	}
 
 	var response StartResponse
-	if err := json.Unmarshal(respBody, &response); err != nil {
-		return StartResponse{}, fmt.Errorf("failed to decode response, body: %s, error: %s", respBody, err)
+	if err := app.doJSON("POST /builds", withoutRateLimitRetries(req), &response); err != nil {
+		return StartResponse{}, err
 	}
 	return response, nil
 }
 
-// GetBuildArtifacts ...
+// GetBuildArtifacts lists every artifact of the build, requesting all the pages.
 func (build Build) GetBuildArtifacts(app App) (BuildArtifactsResponse, error) {
-	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/v0.1/apps/%s/builds/%s/artifacts", app.BaseURL, app.Slug, build.Slug), nil)
-	if err != nil {
-		return BuildArtifactsResponse{}, nil
-	}
-	req.Header.Add("Authorization", "token "+app.AccessToken)
-
-	retryReq, err := retryablehttp.FromRequest(req)
-	if err != nil {
-		return BuildArtifactsResponse{}, fmt.Errorf("failed to create retryable request: %s", err)
-	}
-
-	retryClient := NewRetryableClient(app.IsDebugRetryTimings)
-
-	resp, err := retryClient.Do(retryReq)
-	if err != nil {
-		return BuildArtifactsResponse{}, nil
-	}
-
-	defer func() {
-		if cerr := resp.Body.Close(); cerr != nil && err == nil {
-			err = cerr
-		}
-	}()
-
-	respBody, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return BuildArtifactsResponse{}, nil
-	}
-
-	if resp.StatusCode < 200 || resp.StatusCode > 299 {
-		return BuildArtifactsResponse{}, fmt.Errorf("failed to get response, statuscode: %d, body: %s", resp.StatusCode, respBody)
-	}
-
 	var response BuildArtifactsResponse
-	if err := json.Unmarshal(respBody, &response); err != nil {
-		return BuildArtifactsResponse{}, fmt.Errorf("failed to decode response, body: %s, error: %s", respBody, err)
+	query := url.Values{"limit": {pageItemLimit(0)}}
+	err := app.getPages("GET /builds/{build_slug}/artifacts", "/builds/"+build.Slug+"/artifacts", query, func() pagedResponse {
+		return &BuildArtifactsResponse{}
+	}, func(page pagedResponse) bool {
+		artifacts := page.(*BuildArtifactsResponse)
+		response.ArtifactSlugs = append(response.ArtifactSlugs, artifacts.ArtifactSlugs...)
+		response.Paging = artifacts.Paging
+		return true
+	})
+	if err != nil {
+		return BuildArtifactsResponse{}, err
 	}
 	return response, nil
 }
 
 // GetBuildArtifact ...
 func (build Build) GetBuildArtifact(app App, artifactSlug string) (BuildArtifactResponse, error) {
-	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/v0.1/apps/%s/builds/%s/artifacts/%s", app.BaseURL, app.Slug, build.Slug, artifactSlug), nil)
-	if err != nil {
-		return BuildArtifactResponse{}, nil
+	var response BuildArtifactResponse
+	if err := app.getJSON("GET /builds/{build_slug}/artifacts/{artifact_slug}", app.appURL("/builds/"+build.Slug+"/artifacts/"+artifactSlug), &response); err != nil {
+		return BuildArtifactResponse{}, err
 	}
-	req.Header.Add("Authorization", "token "+app.AccessToken)
+	return response, nil
+}
 
-	retryReq, err := retryablehttp.FromRequest(req)
-	if err != nil {
-		return BuildArtifactResponse{}, fmt.Errorf("failed to create retryable request: %s", err)
-	}
+// BuildLog ...
+type BuildLog struct {
+	ExpiringRawLogURL string          `json:"expiring_raw_log_url"`
+	IsArchived        bool            `json:"is_archived"`
+	LogChunks         []BuildLogChunk `json:"log_chunks"`
+}
 
-	retryClient := NewRetryableClient(app.IsDebugRetryTimings)
+// BuildLogChunk ...
+type BuildLogChunk struct {
+	Chunk    string `json:"chunk"`
+	Position int    `json:"position"`
+}
 
-	resp, err := retryClient.Do(retryReq)
-	if err != nil {
-		return BuildArtifactResponse{}, nil
+// GetBuildLog ...
+func (app App) GetBuildLog(buildSlug string) (BuildLog, error) {
+	var response BuildLog
+	if err := app.getJSON("GET /builds/{build_slug}/log", app.appURL("/builds/"+buildSlug+"/log"), &response); err != nil {
+		return BuildLog{}, err
 	}
+	return response, nil
+}
 
-	defer func() {
-		if cerr := resp.Body.Close(); cerr != nil && err == nil {
-			err = cerr
-		}
-	}()
+// ListBuildsParams filters the builds listed by ListBuilds, zero values are not sent.
+type ListBuildsParams struct {
+	Workflow string
+	Branch   string
+	// Status is a pointer, as the zero value (running) is a valid filter.
+	Status *BuildStatus
+	// Limit is the maximum number of listed builds, every matching build is listed if 0.
+	Limit int
+}
 
-	respBody, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return BuildArtifactResponse{}, nil
+func (params ListBuildsParams) query() url.Values {
+	query := url.Values{}
+	if params.Workflow != "" {
+		query.Set("workflow", params.Workflow)
 	}
-
-	if resp.StatusCode < 200 || resp.StatusCode > 299 {
-		return BuildArtifactResponse{}, fmt.Errorf("failed to get response, statuscode: %d, body: %s", resp.StatusCode, respBody)
+	if params.Branch != "" {
+		query.Set("branch", params.Branch)
 	}
-
-	var response BuildArtifactResponse
-	if err := json.Unmarshal(respBody, &response); err != nil {
-		return BuildArtifactResponse{}, fmt.Errorf("failed to decode response, body: %s, error: %s", respBody, err)
+	if params.Status != nil {
+		query.Set("status", strconv.Itoa(int(*params.Status)))
 	}
-	return response, nil
+	query.Set("limit", pageItemLimit(params.Limit))
+	return query
 }
 
-// DownloadArtifact ...
-func (artifact BuildArtifact) DownloadArtifact(filepath string) error {
-	resp, err := http.Get(artifact.DownloadURL)
-	if err != nil {
-		return err
-	}
-
-	defer func() {
-		if err := resp.Body.Close(); err != nil {
-			fmt.Println("Failed to close body, error:", err)
-		}
-	}()
-
-	out, err := os.Create(filepath)
-	if err != nil {
-		return err
-	}
-
-	defer func() {
-		if err := out.Close(); err != nil {
-			fmt.Println("Failed to close output stream, error:", err)
-		}
-	}()
+// Paging ...
+type Paging struct {
+	TotalItemCount int    `json:"total_item_count"`
+	PageItemLimit  int    `json:"page_item_limit"`
+	Next           string `json:"next"`
+}
 
-	_, err = io.Copy(out, resp.Body)
-	return err
+// ListBuildsResponse ...
+type ListBuildsResponse struct {
+	Builds []Build `json:"data"`
+	Paging Paging  `json:"paging"`
 }
 
-// AbortBuild ...
-func (app App) AbortBuild(buildSlug string, abortReason string) error {
-	b, err := json.Marshal(buildAbortParams{
-		AbortReason:       abortReason,
-		AbortWithSucces:   false,
-		SkipNotifications: true,
+// ListBuilds lists the builds of the app, the most recent first, requesting pages until the limit is reached.
+// The paging of the response is the paging of the last requested page.
+func (app App) ListBuilds(params ListBuildsParams) (ListBuildsResponse, error) {
+	var response ListBuildsResponse
+	err := app.getPages("GET /builds", "/builds", params.query(), func() pagedResponse {
+		return &ListBuildsResponse{}
+	}, func(page pagedResponse) bool {
+		builds := page.(*ListBuildsResponse)
+		response.Builds = append(response.Builds, builds.Builds...)
+		response.Paging = builds.Paging
+		if params.Limit > 0 && len(response.Builds) >= params.Limit {
+			response.Builds = response.Builds[:params.Limit]
+			return false
+		}
+		return true
 	})
 	if err != nil {
-		return fmt.Errorf("failed to marshal abort params: %w", err)
+		return ListBuildsResponse{}, err
 	}
+	return response, nil
+}
 
-	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/v0.1/apps/%s/builds/%s/abort", app.BaseURL, app.Slug, buildSlug), bytes.NewReader(b))
-	if err != nil {
-		return fmt.Errorf("failed to create request: %w", err)
+// Text returns the full log, downloading the raw log with the HTTP client of the app if it is archived.
+func (buildLog BuildLog) Text(app App) (string, error) {
+	if buildLog.ExpiringRawLogURL == "" {
+		chunks := append([]BuildLogChunk{}, buildLog.LogChunks...)
+		sort.Slice(chunks, func(i, j int) bool {
+			return chunks[i].Position < chunks[j].Position
+		})
+
+		var b strings.Builder
+		for _, chunk := range chunks {
+			b.WriteString(chunk.Chunk)
+		}
+		return b.String(), nil
 	}
-	req.Header.Add("Authorization", "token "+app.AccessToken)
 
-	retryReq, err := retryablehttp.FromRequest(req)
-	if err != nil {
-		return fmt.Errorf("failed to create retryable request: %w", err)
+	var b strings.Builder
+	if err := app.download(buildLog.ExpiringRawLogURL, &b); err != nil {
+		return "", fmt.Errorf("failed to download raw log: %s", err)
 	}
+	return b.String(), nil
+}
 
-	retryClient := NewRetryableClient(app.IsDebugRetryTimings)
-
-	resp, err := retryClient.Do(retryReq)
+// DownloadArtifact downloads the artifact to filepath with the HTTP client of the app.
+func (artifact BuildArtifact) DownloadArtifact(app App, filepath string) (err error) {
+	out, err := os.Create(filepath)
 	if err != nil {
-		return fmt.Errorf("failed to send request: %w", err)
+		return err
 	}
 
 	defer func() {
-		if err := resp.Body.Close(); err != nil {
-			log.Warnf("Failed to close response body: %s", err)
+		if cerr := out.Close(); cerr != nil && err == nil {
+			err = cerr
 		}
 	}()
 
-	respBody, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return fmt.Errorf("failed to read response body: %w", err)
-	}
+	return app.download(artifact.DownloadURL, out)
+}
 
-	if resp.StatusCode < 200 || resp.StatusCode > 299 {
-		return fmt.Errorf("failed to get response, statuscode: %d, body: %s", resp.StatusCode, respBody)
-	}
-	return nil
-}
-
-// WaitForBuilds ...
-func (app App) WaitForBuilds(buildSlugs []string, statusChangeCallback func(build Build)) error {
-	failed := false
-	status := map[string]string{}
-	for {
-		running := 0
-		for _, buildSlug := range buildSlugs {
-			build, err := app.GetBuild(buildSlug)
-			if err != nil {
-				return fmt.Errorf("failed to get build info, error: %s", err)
-			}
-
-			if status[buildSlug] != build.StatusText {
-				statusChangeCallback(build)
-				status[buildSlug] = build.StatusText
-			}
-
-			if build.IsRunning() {
-				running++
-				continue
-			}
-
-			if build.IsFailed() || build.IsAborted() {
-				failed = true
-			}
-
-			buildSlugs = remove(buildSlugs, buildSlug)
-		}
-		if running == 0 {
-			break
-		}
-		time.Sleep(time.Second * 3)
-	}
-	if failed {
-		return fmt.Errorf("at least one build failed or aborted")
-	}
-	return nil
+// AbortOptions are the settings of aborting a build.
+type AbortOptions struct {
+	Reason string
+	// WithSuccess marks the aborted build successful.
+	WithSuccess bool
+	// SkipNotifications disables the notifications (e.g. emails) about the aborted build.
+	SkipNotifications bool
 }
 
-func remove(slice []string, what string) (b []string) {
-	for _, s := range slice {
-		if s != what {
-			b = append(b, s)
-		}
-	}
-	return
+// AbortBuild aborts the build as failed, without sending notifications.
+func (app App) AbortBuild(buildSlug string, abortReason string) error {
+	return app.AbortBuildWithOptions(buildSlug, AbortOptions{Reason: abortReason, SkipNotifications: true})
+}
+
+// AbortBuildWithOptions aborts the build with the given options.
+func (app App) AbortBuildWithOptions(buildSlug string, options AbortOptions) error {
+	return app.postJSON("POST /builds/{build_slug}/abort", app.appURL("/builds/"+buildSlug+"/abort"), buildAbortParams{
+		AbortReason:       options.Reason,
+		AbortWithSucces:   options.WithSuccess,
+		SkipNotifications: options.SkipNotifications,
+	}, nil)
 }
@@ -50,3 +50,38 @@ func TestApp_GetBuild(t *testing.T) {
 		})
 	}
 }
+
+func TestBuildLog_Text(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		_, err := writer.Write([]byte("raw log"))
+		require.NoError(t, err)
+	}))
+	defer server.Close()
+
+	chunks := BuildLog{LogChunks: []BuildLogChunk{{Chunk: "b", Position: 1}, {Chunk: "a", Position: 0}}}
+	text, err := chunks.Text(App{})
+	require.NoError(t, err)
+	require.Equal(t, "ab", text)
+
+	raw := BuildLog{ExpiringRawLogURL: server.URL, LogChunks: []BuildLogChunk{{Chunk: "partial"}}}
+	text, err = raw.Text(App{})
+	require.NoError(t, err)
+	require.Equal(t, "raw log", text)
+}
+
+func TestApp_ListBuilds(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		require.Equal(t, "/v0.1/apps/aaa/builds", req.URL.Path)
+		require.Equal(t, "limit=20&status=1&workflow=ui-test", req.URL.RawQuery)
+		_, err := writer.Write([]byte(`{"data":[{"slug":"ccc","status":1}],"paging":{"total_item_count":1,"page_item_limit":20}}`))
+		require.NoError(t, err)
+	}))
+	defer server.Close()
+
+	successful := BuildStatusSuccessful
+	app := App{BaseURL: server.URL, Slug: "aaa", AccessToken: "bbb"}
+	got, err := app.ListBuilds(ListBuildsParams{Workflow: "ui-test", Status: &successful, Limit: 20})
+	require.NoError(t, err)
+	require.Equal(t, []Build{{Slug: "ccc", Status: BuildStatusSuccessful}}, got.Builds)
+	require.Equal(t, 1, got.Paging.TotalItemCount)
+}
@@ -0,0 +1,243 @@
+package bitrise
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/bitrise-io/go-utils/log"
+	"github.com/hashicorp/go-cleanhttp"
+	"github.com/hashicorp/go-retryablehttp"
+)
+
+// DefaultUserAgent identifies the requests of clients created without a User-Agent.
+const DefaultUserAgent = "bitrise-step-build-router-start"
+
+// requestIDHeader is the header identifying a request in the logs of the client and the server.
+const requestIDHeader = "X-Request-ID"
+
+// defaultHTTPClient is shared by the Apps without an HTTP client, so their connections are reused.
+var defaultHTTPClient = cleanhttp.DefaultPooledClient()
+
+// Client is the shared core of the API requests of an App: it reuses the connections, retries the failed requests,
+// identifies the requests with a User-Agent and a request ID, and records the timing metrics if enabled.
+// The copies of an App share its Client, it is safe for concurrent use.
+type Client struct {
+	retryable *retryablehttp.Client
+	userAgent string
+	// metrics is nil if the metrics are not recorded.
+	metrics *Metrics
+}
+
+// NewClient returns a Client sending the requests with httpClient.
+// isDebugRetryTimings sets the retry waits shorter for testing purposes, metrics may be nil.
+func NewClient(httpClient *http.Client, isDebugRetryTimings bool, userAgent string, metrics *Metrics) *Client {
+	retryable := NewRetryableClient(isDebugRetryTimings)
+	retryable.HTTPClient = httpClient
+	retryable.RequestLogHook = countAttempt
+	retryable.CheckRetry = checkRetry
+
+	if userAgent == "" {
+		userAgent = DefaultUserAgent
+	}
+	return &Client{retryable: retryable, userAgent: userAgent, metrics: metrics}
+}
+
+// Metrics returns the recorded metrics, nil if the client doesn't record them.
+func (c *Client) Metrics() *Metrics {
+	return c.metrics
+}
+
+type attemptsKey struct{}
+
+// countAttempt stores the number of attempts of a request in the counter of its context.
+func countAttempt(_ retryablehttp.Logger, req *http.Request, retryNumber int) {
+	if attempts, ok := req.Context().Value(attemptsKey{}).(*int); ok {
+		*attempts = retryNumber + 1
+	}
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// APIError is returned if the API responds with a non 2xx status code.
+type APIError struct {
+	StatusCode int
+	RequestID  string
+	Body       string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("failed to get response, statuscode: %d, request id: %s, body: %s", e.StatusCode, e.RequestID, e.Body)
+}
+
+// do sends the request, with retries, and returns the body of the successful response.
+// endpoint names the API endpoint in the metrics, e.g. "GET /builds/{build_slug}".
+func (c *Client) do(endpoint string, req *http.Request) ([]byte, error) {
+	requestID := newRequestID()
+	req.Header.Set("User-Agent", c.userAgent)
+	req.Header.Set(requestIDHeader, requestID)
+
+	attempts := 0
+	req = req.WithContext(context.WithValue(req.Context(), attemptsKey{}, &attempts))
+
+	retryReq, err := retryablehttp.FromRequest(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create retryable request: %s", err)
+	}
+
+	start := time.Now()
+	statusCode := 0
+	respBody, err := func() ([]byte, error) {
+		resp, err := c.retryable.Do(retryReq)
+		if err != nil {
+			return nil, fmt.Errorf("failed to send request (request id: %s): %s", requestID, err)
+		}
+
+		defer func() {
+			if err := resp.Body.Close(); err != nil {
+				log.Warnf("Failed to close response body: %s", err)
+			}
+		}()
+
+		statusCode = resp.StatusCode
+		respBody, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read response body (request id: %s): %s", requestID, err)
+		}
+
+		if resp.StatusCode == http.StatusTooManyRequests {
+			retryAfter, ok := parseRetryAfter(resp.Header, time.Now())
+			return nil, &RateLimitError{RetryAfter: retryAfter, HasRetryAfter: ok, Body: string(respBody)}
+		}
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return nil, &APIError{StatusCode: resp.StatusCode, RequestID: requestID, Body: string(respBody)}
+		}
+		return respBody, nil
+	}()
+	latency := time.Since(start)
+
+	log.Debugf("%s %s (request id: %s): %d in %s, %d attempt(s)", req.Method, req.URL.Path, requestID, statusCode, latency, attempts)
+	if c.metrics != nil {
+		c.metrics.record(endpoint, latency, attempts, statusCode, err)
+	}
+	return respBody, err
+}
+
+// client returns the Client of the app, Apps created without one (e.g. in tests) get a new Client for each request.
+func (app App) client() *Client {
+	if app.Client != nil {
+		return app.Client
+	}
+	return NewClient(app.httpClient(), app.IsDebugRetryTimings, DefaultUserAgent, nil)
+}
+
+// httpClient returns the HTTP client of the app, the shared default client if it is not configured.
+func (app App) httpClient() *http.Client {
+	if app.HTTPClient != nil {
+		return app.HTTPClient
+	}
+	return defaultHTTPClient
+}
+
+// NewRetryableClient returns a retryable HTTP client sending the requests with the HTTP client of the app.
+func (app App) NewRetryableClient() *retryablehttp.Client {
+	client := NewRetryableClient(app.IsDebugRetryTimings)
+	client.HTTPClient = app.httpClient()
+	return client
+}
+
+// appURL returns the URL of the app scoped API path, e.g. /builds.
+func (app App) appURL(path string) string {
+	return fmt.Sprintf("%s/v0.1/apps/%s%s", app.BaseURL, app.Slug, path)
+}
+
+// getJSON sends a GET request to the URL and decodes the JSON response into response.
+func (app App) getJSON(endpoint, url string, response interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %s", err)
+	}
+	return app.doJSON(endpoint, req, response)
+}
+
+// postJSON sends the JSON encoded body in a POST request to the URL and decodes the JSON response into response,
+// response may be nil if the response is not used.
+func (app App) postJSON(endpoint, url string, body, response interface{}) error {
+	req, err := newJSONRequest(http.MethodPost, url, body)
+	if err != nil {
+		return err
+	}
+	return app.doJSON(endpoint, req, response)
+}
+
+// newJSONRequest returns a request with the JSON encoded body.
+func newJSONRequest(method, url string, body interface{}) (*http.Request, error) {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request body: %s", err)
+	}
+
+	req, err := http.NewRequest(method, url, bytes.NewReader(b))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %s", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return req, nil
+}
+
+func (app App) doJSON(endpoint string, req *http.Request, response interface{}) error {
+	req.Header.Set("Authorization", "token "+app.AccessToken)
+
+	respBody, err := app.client().do(endpoint, req)
+	if err != nil {
+		return err
+	}
+	if response == nil {
+		return nil
+	}
+	if err := json.Unmarshal(respBody, response); err != nil {
+		return fmt.Errorf("failed to decode response, body: %s, error: %s", respBody, err)
+	}
+	return nil
+}
+
+// download streams the body of a GET request to the URL into w, without authentication and retries,
+// as it is used for the expiring download URLs of artifacts and logs.
+func (app App) download(url string, w io.Writer) error {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %s", err)
+	}
+	req.Header.Set("User-Agent", app.client().userAgent)
+
+	resp, err := app.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.Warnf("Failed to close response body: %s", err)
+		}
+	}()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("failed to download, statuscode: %d", resp.StatusCode)
+	}
+
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
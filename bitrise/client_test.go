@@ -0,0 +1,92 @@
+package bitrise
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestClient_requests(t *testing.T) {
+	var userAgents, requestIDs []string
+	buildRequests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userAgents = append(userAgents, r.Header.Get("User-Agent"))
+		requestIDs = append(requestIDs, r.Header.Get(requestIDHeader))
+		require.Equal(t, "token token", r.Header.Get("Authorization"))
+
+		switch r.URL.Path {
+		case "/v0.1/apps/app/builds/slug":
+			buildRequests++
+			if buildRequests == 1 {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			fmt.Fprint(w, `{"data": {"slug": "slug", "status": 1}}`)
+		case "/v0.1/apps/app/builds/slug/artifacts":
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `{"message": "forbidden"}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	metrics := NewMetrics()
+	app := App{BaseURL: server.URL, Slug: "app", AccessToken: "token", Client: NewClient(server.Client(), true, "router/1.0.0", metrics)}
+
+	build, err := app.GetBuild("slug")
+	require.NoError(t, err)
+	require.Equal(t, "slug", build.Slug)
+
+	_, err = build.GetBuildArtifacts(app)
+	var apiErr *APIError
+	require.ErrorAs(t, err, &apiErr)
+	require.Equal(t, http.StatusForbidden, apiErr.StatusCode)
+	require.Equal(t, `{"message": "forbidden"}`, apiErr.Body)
+
+	require.Equal(t, []string{"router/1.0.0", "router/1.0.0", "router/1.0.0"}, userAgents)
+	require.Len(t, requestIDs[0], 16)
+	require.Equal(t, requestIDs[0], requestIDs[1], "the retries of a request keep its ID")
+	require.NotEqual(t, requestIDs[1], requestIDs[2])
+	require.Equal(t, requestIDs[2], apiErr.RequestID)
+
+	endpoints := metrics.Endpoints()
+	require.Len(t, endpoints, 2)
+	require.Equal(t, "GET /builds/{build_slug}", endpoints[0].Endpoint)
+	require.Equal(t, 1, endpoints[0].Count)
+	require.Equal(t, 1, endpoints[0].Retries)
+	require.Equal(t, 0, endpoints[0].Errors)
+	require.Equal(t, map[int]int{http.StatusOK: 1}, endpoints[0].StatusCodes)
+	require.Equal(t, "GET /builds/{build_slug}/artifacts", endpoints[1].Endpoint)
+	require.Equal(t, 1, endpoints[1].Errors)
+	require.Equal(t, map[int]int{http.StatusForbidden: 1}, endpoints[1].StatusCodes)
+
+	require.Len(t, metrics.Lines(), 2)
+	require.Contains(t, metrics.Lines()[0], "GET /builds/{build_slug}: 1 requests, 1 retries, 0 errors")
+}
+
+func TestApp_requestErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	app := App{BaseURL: server.URL, Slug: "app", AccessToken: "token", IsDebugRetryTimings: true}
+
+	_, err := app.StartBuild("wf", []byte(`{"branch": "main"}`), "1", nil)
+	require.Error(t, err)
+
+	_, err = app.StartBuild("wf", []byte(`invalid`), "1", nil)
+	require.Error(t, err)
+
+	_, err = Build{Slug: "slug"}.GetBuildArtifacts(app)
+	require.Error(t, err)
+
+	_, err = Build{Slug: "slug"}.GetBuildArtifact(app, "artifact")
+	require.Error(t, err)
+
+	require.Error(t, app.AbortBuild("slug", "reason"))
+}
@@ -0,0 +1,107 @@
+package bitrise
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EndpointMetrics are the timing metrics of the requests of an API endpoint.
+type EndpointMetrics struct {
+	Endpoint string
+	// Count is the number of requests, Retries is the number of attempts beyond the first one.
+	Count        int
+	Retries      int
+	Errors       int
+	TotalLatency time.Duration
+	MaxLatency   time.Duration
+	// StatusCodes counts the final status code of the requests, 0 stands for requests without a response.
+	StatusCodes map[int]int
+}
+
+// AverageLatency returns the average time of the requests, including the retries.
+func (m EndpointMetrics) AverageLatency() time.Duration {
+	if m.Count == 0 {
+		return 0
+	}
+	return m.TotalLatency / time.Duration(m.Count)
+}
+
+// Metrics records the timing metrics of the API requests by endpoint, it is safe for concurrent use.
+type Metrics struct {
+	mu        sync.Mutex
+	endpoints map[string]*EndpointMetrics
+}
+
+// NewMetrics returns an empty Metrics.
+func NewMetrics() *Metrics {
+	return &Metrics{endpoints: map[string]*EndpointMetrics{}}
+}
+
+func (m *Metrics) record(endpoint string, latency time.Duration, attempts, statusCode int, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e, ok := m.endpoints[endpoint]
+	if !ok {
+		e = &EndpointMetrics{Endpoint: endpoint, StatusCodes: map[int]int{}}
+		m.endpoints[endpoint] = e
+	}
+
+	e.Count++
+	if attempts > 1 {
+		e.Retries += attempts - 1
+	}
+	if err != nil {
+		e.Errors++
+	}
+	e.TotalLatency += latency
+	if latency > e.MaxLatency {
+		e.MaxLatency = latency
+	}
+	e.StatusCodes[statusCode]++
+}
+
+// Endpoints returns the metrics of each endpoint, ordered by endpoint.
+func (m *Metrics) Endpoints() []EndpointMetrics {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var endpoints []EndpointMetrics
+	for _, e := range m.endpoints {
+		copied := *e
+		copied.StatusCodes = map[int]int{}
+		for code, count := range e.StatusCodes {
+			copied.StatusCodes[code] = count
+		}
+		endpoints = append(endpoints, copied)
+	}
+	sort.Slice(endpoints, func(i, j int) bool {
+		return endpoints[i].Endpoint < endpoints[j].Endpoint
+	})
+	return endpoints
+}
+
+// Lines returns a line for each endpoint, e.g. GET /builds/{build_slug}: 12 requests, 1 retries, 0 errors, avg 120ms, max 300ms, status 200x12
+func (m *Metrics) Lines() []string {
+	var lines []string
+	for _, e := range m.Endpoints() {
+		var codes []int
+		for code := range e.StatusCodes {
+			codes = append(codes, code)
+		}
+		sort.Ints(codes)
+
+		var statuses []string
+		for _, code := range codes {
+			statuses = append(statuses, fmt.Sprintf("%dx%d", code, e.StatusCodes[code]))
+		}
+
+		lines = append(lines, fmt.Sprintf("%s: %d requests, %d retries, %d errors, avg %s, max %s, status %s",
+			e.Endpoint, e.Count, e.Retries, e.Errors,
+			e.AverageLatency().Round(time.Millisecond), e.MaxLatency.Round(time.Millisecond), strings.Join(statuses, " ")))
+	}
+	return lines
+}
@@ -0,0 +1,62 @@
+package bitrise
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+)
+
+// maxPageItemLimit is the largest page size accepted by the list endpoints of the API.
+const maxPageItemLimit = 50
+
+// pagedResponse is a page of a list endpoint.
+type pagedResponse interface {
+	paging() Paging
+}
+
+func (r *BuildArtifactsResponse) paging() Paging { return r.Paging }
+
+func (r *ListBuildsResponse) paging() Paging { return r.Paging }
+
+// getPages requests the pages of a list endpoint, following the paging.next cursor of the responses.
+// newPage returns the response to decode the next page into, addPage collects the items of the page
+// and returns false if no more pages are needed.
+func (app App) getPages(endpoint, path string, query url.Values, newPage func() pagedResponse, addPage func(page pagedResponse) bool) error {
+	query = cloneQuery(query)
+	seen := map[string]bool{}
+	for {
+		page := newPage()
+		if err := app.getJSON(endpoint, app.appURL(path+"?"+query.Encode()), page); err != nil {
+			return err
+		}
+		if !addPage(page) {
+			return nil
+		}
+
+		next := page.paging().Next
+		if next == "" {
+			return nil
+		}
+		if seen[next] {
+			return fmt.Errorf("paging cursor (%s) repeated, stopped listing %s", next, endpoint)
+		}
+		seen[next] = true
+		query.Set("next", next)
+	}
+}
+
+func cloneQuery(query url.Values) url.Values {
+	cloned := url.Values{}
+	for key, values := range query {
+		cloned[key] = append([]string{}, values...)
+	}
+	return cloned
+}
+
+// pageItemLimit returns the page size of listing limit items, the largest page size if there is no limit.
+func pageItemLimit(limit int) string {
+	if limit <= 0 || limit > maxPageItemLimit {
+		limit = maxPageItemLimit
+	}
+	return strconv.Itoa(limit)
+}
@@ -0,0 +1,67 @@
+package bitrise
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuild_GetBuildArtifacts_paging(t *testing.T) {
+	var queries []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/v0.1/apps/app/builds/slug/artifacts", r.URL.Path)
+		queries = append(queries, r.URL.RawQuery)
+
+		switch r.URL.Query().Get("next") {
+		case "":
+			fmt.Fprint(w, `{"data": [{"slug": "a1", "title": "1.png"}, {"slug": "a2", "title": "2.png"}], "paging": {"total_item_count": 3, "page_item_limit": 2, "next": "a3"}}`)
+		case "a3":
+			fmt.Fprint(w, `{"data": [{"slug": "a3", "title": "3.png"}], "paging": {"total_item_count": 3, "page_item_limit": 2}}`)
+		}
+	}))
+	defer server.Close()
+
+	app := App{BaseURL: server.URL, Slug: "app", AccessToken: "token", IsDebugRetryTimings: true}
+	response, err := Build{Slug: "slug"}.GetBuildArtifacts(app)
+	require.NoError(t, err)
+	require.Equal(t, []BuildArtifactSlug{{"a1", "1.png"}, {"a2", "2.png"}, {"a3", "3.png"}}, response.ArtifactSlugs)
+	require.Equal(t, []string{"limit=50", "limit=50&next=a3"}, queries)
+}
+
+func TestApp_ListBuilds_paging(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		require.Equal(t, "3", r.URL.Query().Get("limit"))
+
+		switch r.URL.Query().Get("next") {
+		case "":
+			fmt.Fprint(w, `{"data": [{"slug": "b1"}, {"slug": "b2"}], "paging": {"next": "b3"}}`)
+		case "b3":
+			fmt.Fprint(w, `{"data": [{"slug": "b3"}, {"slug": "b4"}], "paging": {"next": "b5"}}`)
+		default:
+			t.Errorf("unexpected page: %s", r.URL.RawQuery)
+		}
+	}))
+	defer server.Close()
+
+	app := App{BaseURL: server.URL, Slug: "app", AccessToken: "token", IsDebugRetryTimings: true}
+	response, err := app.ListBuilds(ListBuildsParams{Limit: 3})
+	require.NoError(t, err)
+	require.Equal(t, []Build{{Slug: "b1"}, {Slug: "b2"}, {Slug: "b3"}}, response.Builds)
+	require.Equal(t, 2, requests)
+}
+
+func TestApp_ListBuilds_repeatedCursor(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"data": [{"slug": "b1"}], "paging": {"next": "same"}}`)
+	}))
+	defer server.Close()
+
+	app := App{BaseURL: server.URL, Slug: "app", AccessToken: "token", IsDebugRetryTimings: true}
+	_, err := app.ListBuilds(ListBuildsParams{})
+	require.EqualError(t, err, "paging cursor (same) repeated, stopped listing GET /builds")
+}
@@ -0,0 +1,84 @@
+package bitrise
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-retryablehttp"
+)
+
+// RateLimitError is returned if the API keeps responding with 429 Too Many Requests after the client retries.
+type RateLimitError struct {
+	// RetryAfter is the wait time requested by the Retry-After header, HasRetryAfter is false if the header is missing
+	// or invalid, so an explicit 0 (retry now) can be told apart from a missing header.
+	RetryAfter    time.Duration
+	HasRetryAfter bool
+	Body          string
+}
+
+func (e *RateLimitError) Error() string {
+	msg := "rate limit exceeded"
+	if e.RetryAfter > 0 {
+		msg += fmt.Sprintf(", retry after %s", e.RetryAfter)
+	}
+	if e.Body != "" {
+		msg += ", body: " + e.Body
+	}
+	return msg
+}
+
+// parseRetryAfter parses the Retry-After header, given either in seconds or as an HTTP date.
+func parseRetryAfter(header http.Header, now time.Time) (time.Duration, bool) {
+	value := strings.TrimSpace(header.Get("Retry-After"))
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if wait := date.Sub(now); wait > 0 {
+			return wait, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+type skipRateLimitRetriesKey struct{}
+
+// withoutRateLimitRetries marks the request, so the client returns a *RateLimitError instead of retrying it
+// if it is rate limited, for callers which pace the retries themselves.
+func withoutRateLimitRetries(req *http.Request) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), skipRateLimitRetriesKey{}, true))
+}
+
+// checkRetry is the retry policy of the client: retryablehttp.DefaultRetryPolicy,
+// except for the rate limited responses of the requests marked by withoutRateLimitRetries.
+func checkRetry(ctx context.Context, resp *http.Response, err error) (bool, error) {
+	if resp != nil && resp.StatusCode == http.StatusTooManyRequests && ctx.Value(skipRateLimitRetriesKey{}) != nil {
+		return false, nil
+	}
+	return retryablehttp.DefaultRetryPolicy(ctx, resp, err)
+}
+
+// retryAfterBackoff waits as long as the Retry-After header of a 429 or 503 response requests, but at most max,
+// otherwise it falls back to the exponential backoff of retryablehttp.
+func retryAfterBackoff(min, max time.Duration, attemptNum int, resp *http.Response) time.Duration {
+	if resp != nil && (resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable) {
+		if wait, ok := parseRetryAfter(resp.Header, time.Now()); ok {
+			if wait > max {
+				return max
+			}
+			return wait
+		}
+	}
+	return retryablehttp.DefaultBackoff(min, max, attemptNum, resp)
+}
@@ -0,0 +1,87 @@
+package bitrise
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_parseRetryAfter(t *testing.T) {
+	now := time.Date(2020, 1, 1, 10, 0, 0, 0, time.UTC)
+	tests := []struct {
+		value  string
+		want   time.Duration
+		wantOK bool
+	}{
+		{value: "", want: 0, wantOK: false},
+		{value: "30", want: 30 * time.Second, wantOK: true},
+		{value: "-1", want: 0, wantOK: false},
+		{value: "Wed, 01 Jan 2020 10:01:30 GMT", want: 90 * time.Second, wantOK: true},
+		{value: "Wed, 01 Jan 2020 09:00:00 GMT", want: 0, wantOK: true},
+		{value: "soon", want: 0, wantOK: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			header := http.Header{}
+			if tt.value != "" {
+				header.Set("Retry-After", tt.value)
+			}
+			got, ok := parseRetryAfter(header, now)
+			require.Equal(t, tt.want, got)
+			require.Equal(t, tt.wantOK, ok)
+		})
+	}
+}
+
+func Test_retryAfterBackoff(t *testing.T) {
+	tests := []struct {
+		name       string
+		statusCode int
+		retryAfter string
+		want       time.Duration
+	}{
+		{name: "retry after", statusCode: http.StatusTooManyRequests, retryAfter: "30", want: 30 * time.Second},
+		{name: "retry now", statusCode: http.StatusServiceUnavailable, retryAfter: "0", want: 0},
+		{name: "clamped", statusCode: http.StatusTooManyRequests, retryAfter: "86400", want: time.Minute},
+		{name: "no header", statusCode: http.StatusTooManyRequests, want: 10 * time.Second},
+		{name: "other status", statusCode: http.StatusInternalServerError, retryAfter: "30", want: 10 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &http.Response{StatusCode: tt.statusCode, Header: http.Header{}}
+			if tt.retryAfter != "" {
+				resp.Header.Set("Retry-After", tt.retryAfter)
+			}
+			require.Equal(t, tt.want, retryAfterBackoff(10*time.Second, time.Minute, 0, resp))
+		})
+	}
+}
+
+func TestApp_StartBuild_rateLimited(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Retry-After", "0")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	app := App{BaseURL: server.URL, Slug: "app", AccessToken: "token", IsDebugRetryTimings: true}
+	_, err := app.StartBuild("wf", json.RawMessage(`{}`), "1", nil)
+
+	var rateLimitErr *RateLimitError
+	require.True(t, errors.As(err, &rateLimitErr), "%v", err)
+	require.Equal(t, time.Duration(0), rateLimitErr.RetryAfter)
+	require.True(t, rateLimitErr.HasRetryAfter)
+	require.Equal(t, 1, requests, "starting a build is not retried by the client, the caller paces the retries")
+
+	requests = 0
+	_, err = app.GetBuild("slug")
+	require.True(t, errors.As(err, &rateLimitErr), "%v", err)
+	require.Equal(t, 4, requests, "other requests are retried by the client")
+}
@@ -0,0 +1,76 @@
+package bitrise
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// BuildStatus is the status of a build, as returned by the API in the status field.
+type BuildStatus int
+
+// The build statuses used by the API.
+const (
+	BuildStatusRunning BuildStatus = iota
+	BuildStatusSuccessful
+	BuildStatusFailed
+	BuildStatusAborted
+	BuildStatusAbortedWithSuccess
+)
+
+var buildStatusNames = map[BuildStatus]string{
+	BuildStatusRunning:            "in-progress",
+	BuildStatusSuccessful:         "success",
+	BuildStatusFailed:             "error",
+	BuildStatusAborted:            "aborted",
+	BuildStatusAbortedWithSuccess: "aborted-with-success",
+}
+
+// String returns the name of the status, matching the status_text values of the API.
+func (s BuildStatus) String() string {
+	if name, ok := buildStatusNames[s]; ok {
+		return name
+	}
+	return "unknown-" + strconv.Itoa(int(s))
+}
+
+// IsTerminal reports if the build is finished.
+func (s BuildStatus) IsTerminal() bool {
+	return s != BuildStatusRunning
+}
+
+// IsSuccess reports if the build finished successfully, builds aborted with success count as successful.
+func (s BuildStatus) IsSuccess() bool {
+	return s == BuildStatusSuccessful || s == BuildStatusAbortedWithSuccess
+}
+
+// IsFailure reports if the build failed or was aborted.
+func (s BuildStatus) IsFailure() bool {
+	return s == BuildStatusFailed || s == BuildStatusAborted
+}
+
+// MarshalJSON encodes the status by its name.
+func (s BuildStatus) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
+// UnmarshalJSON decodes the status either from its numeric API value or from its name.
+func (s *BuildStatus) UnmarshalJSON(b []byte) error {
+	var code int
+	if err := json.Unmarshal(b, &code); err == nil {
+		*s = BuildStatus(code)
+		return nil
+	}
+
+	var name string
+	if err := json.Unmarshal(b, &name); err != nil {
+		return fmt.Errorf("build status should be a number or a string: %s", b)
+	}
+	for status, statusName := range buildStatusNames {
+		if statusName == name {
+			*s = status
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown build status: %s", name)
+}
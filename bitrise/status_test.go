@@ -0,0 +1,50 @@
+package bitrise
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuildStatus_JSON(t *testing.T) {
+	var build Build
+	require.NoError(t, json.Unmarshal([]byte(`{"status": 4, "status_text": "aborted-with-success"}`), &build))
+	require.Equal(t, BuildStatusAbortedWithSuccess, build.Status)
+
+	b, err := json.Marshal(BuildStatusFailed)
+	require.NoError(t, err)
+	require.Equal(t, `"error"`, string(b))
+
+	var status BuildStatus
+	require.NoError(t, json.Unmarshal(b, &status))
+	require.Equal(t, BuildStatusFailed, status)
+
+	require.Error(t, json.Unmarshal([]byte(`"unknown"`), &status))
+	require.Error(t, json.Unmarshal([]byte(`true`), &status))
+}
+
+func TestBuildStatus_predicates(t *testing.T) {
+	tests := []struct {
+		status     BuildStatus
+		name       string
+		isTerminal bool
+		isSuccess  bool
+		isFailure  bool
+	}{
+		{status: BuildStatusRunning, name: "in-progress"},
+		{status: BuildStatusSuccessful, name: "success", isTerminal: true, isSuccess: true},
+		{status: BuildStatusFailed, name: "error", isTerminal: true, isFailure: true},
+		{status: BuildStatusAborted, name: "aborted", isTerminal: true, isFailure: true},
+		{status: BuildStatusAbortedWithSuccess, name: "aborted-with-success", isTerminal: true, isSuccess: true},
+		{status: BuildStatus(9), name: "unknown-9", isTerminal: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.name, tt.status.String())
+			require.Equal(t, tt.isTerminal, tt.status.IsTerminal())
+			require.Equal(t, tt.isSuccess, tt.status.IsSuccess())
+			require.Equal(t, tt.isFailure, tt.status.IsFailure())
+		})
+	}
+}
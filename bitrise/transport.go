@@ -0,0 +1,140 @@
+package bitrise
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-cleanhttp"
+)
+
+// DefaultBaseURL is the URL of the Bitrise API.
+const DefaultBaseURL = "https://api.bitrise.io"
+
+// ClientOptions configure the HTTP client used for the API requests and the artifact and log downloads.
+// Zero values keep the defaults.
+type ClientOptions struct {
+	// ProxyURL is the HTTP(S) proxy of every request, the HTTP_PROXY, HTTPS_PROXY and NO_PROXY envs are used if empty.
+	ProxyURL string
+	// CACertPath is a PEM bundle of certificates trusted in addition to the system ones,
+	// e.g. the certificate of a TLS intercepting proxy.
+	CACertPath string
+	// ClientCertPath and ClientKeyPath are the PEM certificate and key presented for mutual TLS.
+	ClientCertPath string
+	ClientKeyPath  string
+	// Timeout limits a request, including reading the response body.
+	Timeout time.Duration
+	// ConnectTimeout limits establishing a connection, including the TLS handshake.
+	ConnectTimeout time.Duration
+	// UserAgent identifies the client in the API requests, DefaultUserAgent is used if empty.
+	UserAgent string
+	// Metrics records the timing metrics of the API requests if not nil.
+	Metrics *Metrics
+}
+
+// NewHTTPClient returns an HTTP client configured by the options.
+func (options ClientOptions) NewHTTPClient() (*http.Client, error) {
+	transport := cleanhttp.DefaultPooledTransport()
+
+	if options.ProxyURL != "" {
+		// The proxy URL may hold credentials, so it is not included in the errors.
+		proxyURL, err := url.Parse(options.ProxyURL)
+		if err != nil {
+			var urlErr *url.Error
+			if errors.As(err, &urlErr) {
+				err = urlErr.Err
+			}
+			return nil, fmt.Errorf("invalid proxy URL: %s", err)
+		}
+		if proxyURL.Scheme == "" || proxyURL.Host == "" {
+			return nil, fmt.Errorf("invalid proxy URL: scheme and host are required")
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	if options.CACertPath != "" || options.ClientCertPath != "" || options.ClientKeyPath != "" {
+		tlsConfig, err := options.tlsConfig()
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	if options.ConnectTimeout > 0 {
+		transport.DialContext = (&net.Dialer{
+			Timeout:   options.ConnectTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext
+		transport.TLSHandshakeTimeout = options.ConnectTimeout
+	}
+
+	return &http.Client{Transport: transport, Timeout: options.Timeout}, nil
+}
+
+func (options ClientOptions) tlsConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if options.CACertPath != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+
+		pem, err := ioutil.ReadFile(options.CACertPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA bundle: %s", err)
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in CA bundle (%s)", options.CACertPath)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if options.ClientCertPath != "" || options.ClientKeyPath != "" {
+		if options.ClientCertPath == "" || options.ClientKeyPath == "" {
+			return nil, fmt.Errorf("both the client certificate and key are required")
+		}
+		cert, err := tls.LoadX509KeyPair(options.ClientCertPath, options.ClientKeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %s", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// NewApp returns a Bitrise client of the API at baseURL (DefaultBaseURL if empty), sending the requests
+// with an HTTP client configured by the options.
+func NewApp(baseURL, slug, accessToken string, options ClientOptions) (App, error) {
+	if baseURL == "" {
+		baseURL = DefaultBaseURL
+	}
+	parsed, err := url.Parse(baseURL)
+	if err != nil {
+		return App{}, fmt.Errorf("invalid base URL (%s): %s", baseURL, err)
+	}
+	if parsed.Scheme == "" || parsed.Host == "" {
+		return App{}, fmt.Errorf("invalid base URL (%s): scheme and host are required", baseURL)
+	}
+
+	httpClient, err := options.NewHTTPClient()
+	if err != nil {
+		return App{}, err
+	}
+
+	return App{
+		BaseURL:     strings.TrimRight(baseURL, "/"),
+		Slug:        slug,
+		AccessToken: accessToken,
+		HTTPClient:  httpClient,
+		Client:      NewClient(httpClient, false, options.UserAgent, options.Metrics),
+	}, nil
+}
@@ -0,0 +1,160 @@
+package bitrise
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+const defaultPollInterval = 3 * time.Second
+
+// BuildResult is the outcome of waiting for a build.
+type BuildResult struct {
+	Slug     string
+	Workflow string
+	Status   BuildStatus
+	// TriggeredAt, StartedAt and FinishedAt come from the API,
+	// if it doesn't report them, the time of the first and last status check is used.
+	TriggeredAt time.Time
+	StartedAt   time.Time
+	FinishedAt  time.Time
+	// Polls is the number of status checks made for the build.
+	Polls int
+}
+
+// Duration returns the time the build took from being started on a worker (or triggered) until it finished.
+func (r BuildResult) Duration() time.Duration {
+	start := r.StartedAt
+	if start.IsZero() {
+		start = r.TriggeredAt
+	}
+	if start.IsZero() || r.FinishedAt.IsZero() {
+		return 0
+	}
+	return r.FinishedAt.Sub(start)
+}
+
+// BuildsFailedError is returned by WaitForBuilds if any of the builds failed or was aborted.
+type BuildsFailedError struct {
+	Failed []BuildResult
+}
+
+func (e *BuildsFailedError) Error() string {
+	var builds []string
+	for _, result := range e.Failed {
+		builds = append(builds, fmt.Sprintf("%s (%s) %s", result.Workflow, result.Slug, result.Status))
+	}
+
+	noun := "builds"
+	if len(e.Failed) == 1 {
+		noun = "build"
+	}
+	return fmt.Sprintf("%d %s failed or aborted: %s", len(e.Failed), noun, strings.Join(builds, ", "))
+}
+
+// buildWaiter tracks a single build while waiting for it.
+type buildWaiter struct {
+	result         BuildResult
+	lastStatusText string
+	finished       bool
+}
+
+func (w *buildWaiter) update(build Build, now time.Time) (statusChanged bool) {
+	w.result.Polls++
+	w.result.Workflow = build.TriggeredWorkflow
+	w.result.Status = build.Status
+
+	if w.result.TriggeredAt.IsZero() {
+		w.result.TriggeredAt = now
+	}
+	if build.TriggeredAt != nil {
+		w.result.TriggeredAt = *build.TriggeredAt
+	}
+	if build.StartedOnWorkerAt != nil {
+		w.result.StartedAt = *build.StartedOnWorkerAt
+	}
+
+	if build.Status.IsTerminal() {
+		w.finished = true
+		w.result.FinishedAt = now
+		if build.FinishedAt != nil {
+			w.result.FinishedAt = *build.FinishedAt
+		}
+	}
+
+	statusChanged = w.lastStatusText != build.StatusText || w.result.Polls == 1
+	w.lastStatusText = build.StatusText
+	return statusChanged
+}
+
+// WaitForBuilds polls the given builds until all of them finish.
+// statusChangeCallback is called on the first status check of a build and every time its status text changes.
+// The results are returned in the order of buildSlugs, a *BuildsFailedError is returned if any of the builds failed.
+func (app App) WaitForBuilds(buildSlugs []string, statusChangeCallback func(build Build)) ([]BuildResult, error) {
+	return app.WaitForBuildsWithProgress(buildSlugs, statusChangeCallback, nil)
+}
+
+// WaitForBuildsWithProgress is WaitForBuilds, calling progressCallback (if not nil) with the current results
+// after each round of status checks while any of the builds is running.
+// If progressCallback returns an error, waiting stops and the error is returned.
+func (app App) WaitForBuildsWithProgress(buildSlugs []string, statusChangeCallback func(build Build), progressCallback func(results []BuildResult) error) ([]BuildResult, error) {
+	pollInterval := app.PollInterval
+	if pollInterval == 0 {
+		pollInterval = defaultPollInterval
+	}
+
+	waiters := make([]*buildWaiter, len(buildSlugs))
+	for i, buildSlug := range buildSlugs {
+		waiters[i] = &buildWaiter{result: BuildResult{Slug: buildSlug}}
+	}
+
+	results := func() []BuildResult {
+		var results []BuildResult
+		for _, w := range waiters {
+			results = append(results, w.result)
+		}
+		return results
+	}
+
+	for {
+		running := 0
+		for _, w := range waiters {
+			if w.finished {
+				continue
+			}
+
+			build, err := app.GetBuild(w.result.Slug)
+			if err != nil {
+				return results(), fmt.Errorf("failed to get build info, error: %s", err)
+			}
+
+			if w.update(build, time.Now()) {
+				statusChangeCallback(build)
+			}
+
+			if !w.finished {
+				running++
+			}
+		}
+		if running == 0 {
+			break
+		}
+		if progressCallback != nil {
+			if err := progressCallback(results()); err != nil {
+				return results(), err
+			}
+		}
+		time.Sleep(pollInterval)
+	}
+
+	var failed []BuildResult
+	for _, w := range waiters {
+		if w.result.Status.IsFailure() {
+			failed = append(failed, w.result)
+		}
+	}
+	if len(failed) > 0 {
+		return results(), &BuildsFailedError{Failed: failed}
+	}
+	return results(), nil
+}
@@ -0,0 +1,103 @@
+package bitrise
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestApp_WaitForBuilds(t *testing.T) {
+	var mu sync.Mutex
+	polls := map[string]int{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		slug := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+		polls[slug]++
+
+		switch {
+		case slug == "slow" && polls[slug] < 3:
+			fmt.Fprint(w, `{"data": {"slug": "slow", "status": 0, "status_text": "in-progress", "triggered_workflow": "ui-test"}}`)
+		case slug == "slow":
+			fmt.Fprint(w, `{"data": {"slug": "slow", "status": 1, "status_text": "success", "triggered_workflow": "ui-test", "started_on_worker_at": "2022-01-01T10:00:00Z", "finished_at": "2022-01-01T10:05:00Z"}}`)
+		case slug == "failing":
+			fmt.Fprint(w, `{"data": {"slug": "failing", "status": 2, "status_text": "error", "triggered_workflow": "unit-test"}}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	app := App{BaseURL: server.URL, Slug: "app", AccessToken: "token", IsDebugRetryTimings: true, PollInterval: time.Millisecond}
+
+	var changes []string
+	results, err := app.WaitForBuilds([]string{"slow", "failing"}, func(build Build) {
+		changes = append(changes, build.Slug+" "+build.StatusText)
+	})
+
+	require.Equal(t, []string{"slow in-progress", "failing error", "slow success"}, changes)
+
+	var failedErr *BuildsFailedError
+	require.True(t, errors.As(err, &failedErr))
+	require.Equal(t, "1 build failed or aborted: unit-test (failing) error", err.Error())
+
+	require.Len(t, results, 2)
+	require.Equal(t, "slow", results[0].Slug)
+	require.Equal(t, BuildStatusSuccessful, results[0].Status)
+	require.Equal(t, 3, results[0].Polls)
+	require.Equal(t, 5*time.Minute, results[0].Duration())
+	require.Equal(t, "failing", results[1].Slug)
+	require.Equal(t, BuildStatusFailed, results[1].Status)
+	require.Equal(t, 1, results[1].Polls)
+	require.Equal(t, []BuildResult{results[1]}, failedErr.Failed)
+}
+
+func TestApp_WaitForBuildsWithProgress(t *testing.T) {
+	polls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		polls++
+		if polls < 3 {
+			fmt.Fprint(w, `{"data": {"slug": "build", "status": 0, "status_text": "in-progress", "triggered_workflow": "ui-test"}}`)
+			return
+		}
+		fmt.Fprint(w, `{"data": {"slug": "build", "status": 1, "status_text": "success", "triggered_workflow": "ui-test"}}`)
+	}))
+	defer server.Close()
+
+	app := App{BaseURL: server.URL, Slug: "app", AccessToken: "token", IsDebugRetryTimings: true, PollInterval: time.Millisecond}
+
+	var snapshots [][]BuildResult
+	_, err := app.WaitForBuildsWithProgress([]string{"build"}, func(Build) {}, func(results []BuildResult) error {
+		snapshots = append(snapshots, results)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Len(t, snapshots, 2)
+	require.Equal(t, BuildStatusRunning, snapshots[1][0].Status)
+	require.Equal(t, 2, snapshots[1][0].Polls)
+}
+
+func TestApp_WaitForBuildsWithProgress_stop(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"data": {"slug": "build", "status": 0, "status_text": "in-progress", "triggered_workflow": "ui-test"}}`)
+	}))
+	defer server.Close()
+
+	app := App{BaseURL: server.URL, Slug: "app", AccessToken: "token", IsDebugRetryTimings: true, PollInterval: time.Millisecond}
+
+	stopErr := errors.New("build is hung")
+	results, err := app.WaitForBuildsWithProgress([]string{"build"}, func(Build) {}, func([]BuildResult) error {
+		return stopErr
+	})
+	require.Equal(t, stopErr, err)
+	require.Len(t, results, 1)
+	require.Equal(t, 1, results[0].Polls)
+}
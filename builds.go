@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bitrise-io/go-steputils/tools"
+	"github.com/bitrise-steplib/bitrise-step-build-router-start/bitrise"
+)
+
+const (
+	envBuildSlugPrefix   = "ROUTER_BUILD_SLUG_"
+	envBuildURLPrefix    = "ROUTER_BUILD_URL_"
+	envBuildNumberPrefix = "ROUTER_BUILD_NUMBER_"
+	envBuildStatusPrefix = "ROUTER_BUILD_STATUS_"
+)
+
+// routedBuild is a build started by the Step.
+type routedBuild struct {
+	Workflow string `json:"workflow"`
+	// EnvKey identifies the build in the exported env keys, it is unique among the routed builds.
+	EnvKey      string `json:"env_key"`
+	Slug        string `json:"slug"`
+	BuildNumber int64  `json:"build_number"`
+	URL         string `json:"url"`
+	// Attempt is the number of Step runs which started or resumed waiting for the build.
+	Attempt             int                 `json:"attempt"`
+	Status              bitrise.BuildStatus `json:"status"`
+	StartedAt           *time.Time          `json:"started_at,omitempty"`
+	FinishedAt          *time.Time          `json:"finished_at,omitempty"`
+	DownloadedArtifacts []string            `json:"downloaded_artifacts,omitempty"`
+	// Stage is the 1-based number of the stage the build belongs to, 0 if the workflows are not split into stages.
+	Stage int `json:"stage,omitempty"`
+	// Retries is the number of times the build was restarted after failing, PreviousSlugs are the failed builds.
+	Retries       int      `json:"retries,omitempty"`
+	PreviousSlugs []string `json:"previous_slugs,omitempty"`
+	// Reused is set if an earlier successful build of the workflow, on the same commit, was adopted instead of starting one.
+	Reused bool `json:"reused,omitempty"`
+}
+
+// update stores the status and the timing of the build reported by the API.
+func (b *routedBuild) update(build bitrise.Build) {
+	b.Status = build.Status
+	if build.StartedOnWorkerAt != nil {
+		b.StartedAt = build.StartedOnWorkerAt
+	} else if b.StartedAt == nil {
+		b.StartedAt = build.TriggeredAt
+	}
+	b.FinishedAt = build.FinishedAt
+}
+
+// retry replaces the failed build with its restarted build.
+func (b *routedBuild) retry(started bitrise.StartResponse) {
+	b.PreviousSlugs = append(b.PreviousSlugs, b.Slug)
+	b.Retries++
+	b.Slug = started.BuildSlug
+	b.BuildNumber = int64(started.BuildNumber)
+	b.URL = started.BuildURL
+	b.Status = bitrise.BuildStatusRunning
+	b.StartedAt = nil
+	b.FinishedAt = nil
+	b.DownloadedArtifacts = nil
+}
+
+// duration returns the time the build took, 0 if it is not finished.
+func (b routedBuild) duration() time.Duration {
+	if b.StartedAt == nil || b.FinishedAt == nil {
+		return 0
+	}
+	return b.FinishedAt.Sub(*b.StartedAt)
+}
+
+func (b routedBuild) isArtifactDownloaded(title string) bool {
+	for _, downloaded := range b.DownloadedArtifacts {
+		if downloaded == title {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultAppBaseURL is the URL of the Bitrise website, the build pages are at <app base URL>/build/<build slug>.
+const defaultAppBaseURL = "https://app.bitrise.io"
+
+func buildURL(appBaseURL, buildSlug string) string {
+	appBaseURL = strings.TrimSuffix(strings.TrimSpace(appBaseURL), "/")
+	if appBaseURL == "" {
+		appBaseURL = defaultAppBaseURL
+	}
+	return appBaseURL + "/build/" + buildSlug
+}
+
+// workflowEnvKeys returns a unique env key fragment for each workflow.
+// If a workflow is listed multiple times or multiple workflows map to the same key,
+// the later occurrences get a numeric suffix: UI_TEST, UI_TEST_2, ...
+func workflowEnvKeys(workflows []string) []string {
+	used := map[string]bool{}
+	keys := make([]string, len(workflows))
+	for i, wf := range workflows {
+		base := sanitizeEnvKey(wf)
+		key := base
+		for n := 2; used[key]; n++ {
+			key = base + "_" + strconv.Itoa(n)
+		}
+		used[key] = true
+		keys[i] = key
+	}
+	return keys
+}
+
+func exportEnvs(envs ...bitrise.Environment) error {
+	for _, env := range envs {
+		if err := tools.ExportEnvironmentWithEnvman(env.MappedTo, env.Value); err != nil {
+			return fmt.Errorf("failed to export %s: %s", env.MappedTo, err)
+		}
+	}
+	return nil
+}
+
+// exportStartedBuild exports the slug, URL and number of the started build as ROUTER_BUILD_*_<WORKFLOW> envs.
+func exportStartedBuild(build routedBuild) error {
+	return exportEnvs(
+		bitrise.Environment{MappedTo: envBuildSlugPrefix + build.EnvKey, Value: build.Slug},
+		bitrise.Environment{MappedTo: envBuildURLPrefix + build.EnvKey, Value: build.URL},
+		bitrise.Environment{MappedTo: envBuildNumberPrefix + build.EnvKey, Value: strconv.FormatInt(build.BuildNumber, 10)},
+	)
+}
+
+// exportBuildStatus exports the status of the finished build as ROUTER_BUILD_STATUS_<WORKFLOW> env.
+func exportBuildStatus(build routedBuild) error {
+	return exportEnvs(bitrise.Environment{MappedTo: envBuildStatusPrefix + build.EnvKey, Value: build.Status.String()})
+}
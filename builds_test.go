@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_workflowEnvKeys(t *testing.T) {
+	tests := []struct {
+		name      string
+		workflows []string
+		want      []string
+	}{
+		{
+			name:      "unique workflows",
+			workflows: []string{"ui-test", "unit_test"},
+			want:      []string{"UI_TEST", "UNIT_TEST"},
+		},
+		{
+			name:      "duplicate workflows",
+			workflows: []string{"deploy", "deploy", "deploy"},
+			want:      []string{"DEPLOY", "DEPLOY_2", "DEPLOY_3"},
+		},
+		{
+			name:      "workflows sanitized to the same key",
+			workflows: []string{"ui-test", "ui.test", "UI_TEST_2"},
+			want:      []string{"UI_TEST", "UI_TEST_2", "UI_TEST_2_2"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, workflowEnvKeys(tt.workflows))
+		})
+	}
+}
+
+func Test_router_buildURL(t *testing.T) {
+	r := router{cfg: Config{BuildSlug: "parent"}}
+	require.Equal(t, "https://app.bitrise.io/build/slug", r.buildURL("slug"))
+	require.Equal(t, "https://app.bitrise.io/build/parent", r.parentBuildURL())
+
+	r.cfg.AppBaseURL = "https://bitrise.example.com/"
+	require.Equal(t, "https://bitrise.example.com/build/slug", r.buildURL("slug"))
+	require.Equal(t, "https://bitrise.example.com/build/parent", r.parentBuildURL())
+
+	r.cfg.ParentBuildURL = "https://ci.example.com/build/parent"
+	require.Equal(t, "https://ci.example.com/build/parent", r.parentBuildURL())
+}
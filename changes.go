@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/command"
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// pathRule starts the workflows if any of the changed files matches the glob.
+type pathRule struct {
+	glob      string
+	workflows []string
+}
+
+// parsePathRules parses the changed_files_rules input, a rule per line: GLOB[, GLOB...] -> WORKFLOW[, WORKFLOW...].
+// Globs are matched against the changed file paths relative to the repository root, ** matches any number of directories.
+func parsePathRules(s string) ([]pathRule, error) {
+	var rules []pathRule
+	for _, line := range splitLines(s) {
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		split := strings.SplitN(line, "->", 2)
+		if len(split) != 2 {
+			return nil, fmt.Errorf("invalid rule, expected GLOB -> WORKFLOW (%s)", line)
+		}
+
+		var workflows []string
+		for _, wf := range strings.Split(split[1], ",") {
+			if wf = strings.TrimSpace(wf); wf != "" {
+				workflows = append(workflows, wf)
+			}
+		}
+		if len(workflows) == 0 {
+			return nil, fmt.Errorf("no workflow given (%s)", line)
+		}
+
+		globs := 0
+		for _, glob := range strings.Split(split[0], ",") {
+			if glob = strings.TrimSpace(glob); glob == "" {
+				continue
+			}
+			if _, err := path.Match(strings.Replace(glob, "**", "*", -1), ""); err != nil {
+				return nil, fmt.Errorf("invalid glob (%s): %s", glob, err)
+			}
+			rules = append(rules, pathRule{glob: glob, workflows: workflows})
+			globs++
+		}
+		if globs == 0 {
+			return nil, fmt.Errorf("empty glob (%s)", line)
+		}
+	}
+	return rules, nil
+}
+
+// matchPathGlob matches the slash separated name against the pattern,
+// where ** matches zero or more path segments and any other segment is matched by path.Match.
+func matchPathGlob(pattern, name string) bool {
+	return matchPathSegments(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchPathSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchPathSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+
+		if len(name) == 0 {
+			return false
+		}
+		if matched, err := path.Match(pattern[0], name[0]); err != nil || !matched {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+func (r pathRule) hasWorkflow(workflow string) bool {
+	for _, wf := range r.workflows {
+		if wf == workflow {
+			return true
+		}
+	}
+	return false
+}
+
+// selectWorkflowsByChanges includes the workflows having a rule which matches any of the changed files.
+// Workflows without any rule are always included.
+func selectWorkflowsByChanges(workflows []string, rules []pathRule, changedFiles []string) []workflowSelection {
+	var selections []workflowSelection
+	for _, wf := range workflows {
+		selection := workflowSelection{Workflow: wf}
+
+		var globs []string
+		for _, rule := range rules {
+			if !rule.hasWorkflow(wf) {
+				continue
+			}
+			globs = append(globs, rule.glob)
+
+			for _, file := range changedFiles {
+				if matchPathGlob(rule.glob, file) {
+					selection.Included = true
+					selection.Reason = fmt.Sprintf("%s matches %s", file, rule.glob)
+					break
+				}
+			}
+			if selection.Included {
+				break
+			}
+		}
+
+		switch {
+		case len(globs) == 0:
+			selection.Included = true
+			selection.Reason = "no changed files rule for the Workflow"
+		case !selection.Included:
+			selection.Reason = fmt.Sprintf("no changed file matches %s", strings.Join(globs, ", "))
+		}
+		selections = append(selections, selection)
+	}
+	return selections
+}
+
+// diffBaseRef returns the ref to compare the checkout against: the configured ref,
+// or the target branch of the pull request the parent build runs for.
+func diffBaseRef(configuredRef string, buildParams json.RawMessage) string {
+	if ref := strings.TrimSpace(configuredRef); ref != "" {
+		return ref
+	}
+
+	var params struct {
+		BranchDest string `json:"branch_dest"`
+	}
+	if err := json.Unmarshal(buildParams, &params); err != nil || params.BranchDest == "" {
+		return ""
+	}
+	return "origin/" + params.BranchDest
+}
+
+// remoteBranch splits the ref into a remote and a branch name, refs without a known remote prefix
+// (e.g. main or release/1.0) are branches of origin.
+func remoteBranch(ref string, remotes []string) (string, string) {
+	if split := strings.SplitN(ref, "/", 2); len(split) == 2 && contains(remotes, split[0]) {
+		return split[0], split[1]
+	}
+	return "origin", ref
+}
+
+// changedFiles lists the files changed on HEAD since it diverged from the base ref.
+// If the base ref is not available locally, it is fetched as a remote branch and HEAD is compared to the fetched ref.
+func changedFiles(dir, baseRef string) ([]string, error) {
+	git := func(args ...string) (string, error) {
+		cmd := command.New("git", args...).SetDir(dir)
+		log.Debugf("$ %s", cmd.PrintableCommandArgs())
+		return cmd.RunAndReturnTrimmedCombinedOutput()
+	}
+
+	if _, err := git("rev-parse", "--verify", "--quiet", baseRef+"^{commit}"); err != nil {
+		// The base ref is not available locally (e.g. only the PR branch is cloned), fetch it as a remote branch.
+		remotesOut, err := git("remote")
+		if err != nil {
+			return nil, fmt.Errorf("failed to list git remotes: %s", remotesOut)
+		}
+		remote, branch := remoteBranch(baseRef, splitLines(remotesOut))
+		baseRef = remote + "/" + branch
+
+		if _, err := git("rev-parse", "--verify", "--quiet", baseRef+"^{commit}"); err != nil {
+			if out, err := git("fetch", remote, "+refs/heads/"+branch+":refs/remotes/"+baseRef); err != nil {
+				return nil, fmt.Errorf("failed to fetch %s: %s", baseRef, out)
+			}
+		}
+	}
+
+	out, err := git("diff", "--name-only", baseRef+"...HEAD")
+	if err != nil {
+		// Shallow clones may not have the merge base, compare the two commits directly instead.
+		log.Debugf("Failed to diff against the merge base of %s: %s", baseRef, out)
+		out, err = git("diff", "--name-only", baseRef, "HEAD")
+		if err != nil {
+			return nil, fmt.Errorf("failed to diff against %s: %s", baseRef, out)
+		}
+	}
+	return splitLines(out), nil
+}
+
+// changedFilesSelections applies the changed files rules to the workflows.
+// It returns nil if there are no rules, or every workflow has to be started as the changed files can't be determined.
+func (r *router) changedFilesSelections(workflows []string, buildParams json.RawMessage) ([]workflowSelection, error) {
+	rules, err := parsePathRules(r.cfg.ChangedFilesRules)
+	if err != nil {
+		return nil, fmt.Errorf("invalid changed files rules: %s", err)
+	}
+	if len(rules) == 0 {
+		return nil, nil
+	}
+
+	for _, rule := range rules {
+		for _, wf := range rule.workflows {
+			if !contains(workflows, wf) {
+				log.Warnf("Changed files rule %s refers to %s, which is not in the workflows input", rule.glob, wf)
+			}
+		}
+	}
+
+	baseRef := diffBaseRef(r.cfg.DiffBaseRef, buildParams)
+	if baseRef == "" {
+		log.Warnf("No base ref to compare the changes against (diff_base_ref is empty and the build is not a pull request build), starting every Workflow")
+		return nil, nil
+	}
+
+	files, err := changedFiles(r.cfg.SourceDir, baseRef)
+	if err != nil {
+		log.Warnf("Failed to get changed files, starting every Workflow: %s", err)
+		return nil, nil
+	}
+	log.Printf("%d file(s) changed since %s", len(files), baseRef)
+	for _, file := range files {
+		log.Debugf("- %s", file)
+	}
+
+	return selectWorkflowsByChanges(workflows, rules, files), nil
+}
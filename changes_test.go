@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_parsePathRules(t *testing.T) {
+	rules, err := parsePathRules("# comment\nios/** -> test-ios\n android/**, shared/** -> test-android, lint \n")
+	require.NoError(t, err)
+	require.Equal(t, []pathRule{
+		{glob: "ios/**", workflows: []string{"test-ios"}},
+		{glob: "android/**", workflows: []string{"test-android", "lint"}},
+		{glob: "shared/**", workflows: []string{"test-android", "lint"}},
+	}, rules)
+
+	for _, invalid := range []string{"ios/**", " -> test-ios", "ios/** -> ", "ios/[ -> test-ios"} {
+		_, err := parsePathRules(invalid)
+		require.Error(t, err, invalid)
+	}
+}
+
+func Test_matchPathGlob(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		want    bool
+	}{
+		{pattern: "ios/**", name: "ios/App/main.swift", want: true},
+		{pattern: "ios/**", name: "ios", want: true},
+		{pattern: "ios/**", name: "android/ios/main.kt", want: false},
+		{pattern: "**/*.md", name: "README.md", want: true},
+		{pattern: "**/*.md", name: "docs/guide/setup.md", want: true},
+		{pattern: "docs/*.md", name: "docs/guide/setup.md", want: false},
+		{pattern: "src/**/test/*.go", name: "src/a/b/test/x.go", want: true},
+		{pattern: "src/**/test/*.go", name: "src/test/x.go", want: true},
+		{pattern: "Gemfile", name: "Gemfile", want: true},
+		{pattern: "Gemfile", name: "Gemfile.lock", want: false},
+	}
+	for _, tt := range tests {
+		require.Equal(t, tt.want, matchPathGlob(tt.pattern, tt.name), "%s %s", tt.pattern, tt.name)
+	}
+}
+
+func Test_selectWorkflowsByChanges(t *testing.T) {
+	rules := []pathRule{
+		{glob: "ios/**", workflows: []string{"test-ios"}},
+		{glob: "android/**", workflows: []string{"test-android"}},
+	}
+	got := selectWorkflowsByChanges([]string{"test-ios", "test-android", "lint"}, rules, []string{"ios/App.swift"})
+	require.Equal(t, []workflowSelection{
+		{Workflow: "test-ios", Included: true, Reason: "ios/App.swift matches ios/**"},
+		{Workflow: "test-android", Included: false, Reason: "no changed file matches android/**"},
+		{Workflow: "lint", Included: true, Reason: "no changed files rule for the Workflow"},
+	}, got)
+}
+
+func Test_diffBaseRef(t *testing.T) {
+	require.Equal(t, "origin/develop", diffBaseRef(" origin/develop ", json.RawMessage(`{"branch_dest": "main"}`)))
+	require.Equal(t, "origin/main", diffBaseRef("", json.RawMessage(`{"branch": "feature", "branch_dest": "main"}`)))
+	require.Equal(t, "", diffBaseRef("", json.RawMessage(`{"branch": "main"}`)))
+	require.Equal(t, "", diffBaseRef("", nil))
+}
+
+func Test_changedFiles(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	dir := t.TempDir()
+	git := func(args ...string) {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+		cmd.Dir = dir
+		out, err := cmd.CombinedOutput()
+		require.NoError(t, err, string(out))
+	}
+	write := func(name string) {
+		pth := filepath.Join(dir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(pth), 0755))
+		require.NoError(t, ioutil.WriteFile(pth, []byte(name), 0644))
+	}
+
+	git("init", "-q")
+	write("README.md")
+	git("add", "-A")
+	git("commit", "-q", "-m", "initial")
+	git("branch", "base")
+	write("ios/App.swift")
+	write("docs/setup.md")
+	git("add", "-A")
+	git("commit", "-q", "-m", "change")
+
+	files, err := changedFiles(dir, "base")
+	require.NoError(t, err)
+	require.Equal(t, []string{"docs/setup.md", "ios/App.swift"}, files)
+}
+
+func Test_remoteBranch(t *testing.T) {
+	remotes := []string{"origin", "upstream"}
+	for ref, want := range map[string][2]string{
+		"main":               {"origin", "main"},
+		"origin/main":        {"origin", "main"},
+		"upstream/main":      {"upstream", "main"},
+		"release/1.0":        {"origin", "release/1.0"},
+		"origin/release/1.0": {"origin", "release/1.0"},
+	} {
+		remote, branch := remoteBranch(ref, remotes)
+		require.Equal(t, want, [2]string{remote, branch}, ref)
+	}
+}
+
+func Test_changedFiles_fetchesBaseRef(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	git := func(dir string, args ...string) {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+		cmd.Dir = dir
+		out, err := cmd.CombinedOutput()
+		require.NoError(t, err, string(out))
+	}
+
+	origin := t.TempDir()
+	git(origin, "init", "-q")
+	git(origin, "checkout", "-q", "-b", "main")
+	require.NoError(t, ioutil.WriteFile(filepath.Join(origin, "README.md"), []byte("readme"), 0644))
+	git(origin, "add", "-A")
+	git(origin, "commit", "-q", "-m", "initial")
+	git(origin, "branch", "release/1.0")
+	git(origin, "checkout", "-q", "-b", "feature")
+	require.NoError(t, os.MkdirAll(filepath.Join(origin, "ios"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(origin, "ios", "App.swift"), []byte("app"), 0644))
+	git(origin, "add", "-A")
+	git(origin, "commit", "-q", "-m", "change")
+
+	for _, baseRef := range []string{"main", "origin/main", "release/1.0"} {
+		t.Run(baseRef, func(t *testing.T) {
+			// Only the feature branch is cloned, like on a pull request build.
+			clone := filepath.Join(t.TempDir(), "clone")
+			git(origin, "clone", "-q", "--single-branch", "--branch", "feature", origin, clone)
+
+			files, err := changedFiles(clone, baseRef)
+			require.NoError(t, err)
+			require.Equal(t, []string{"ios/App.swift"}, files)
+		})
+	}
+}
@@ -0,0 +1,463 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/log"
+	"github.com/bitrise-steplib/bitrise-step-build-router-start/bitrise"
+)
+
+// condValue is the result of evaluating a condition expression, a string or a bool.
+type condValue struct {
+	str    string
+	isBool bool
+	b      bool
+}
+
+func boolValue(b bool) condValue {
+	return condValue{isBool: true, b: b}
+}
+
+func (v condValue) truthy() bool {
+	if v.isBool {
+		return v.b
+	}
+	return v.str != ""
+}
+
+func (v condValue) String() string {
+	if v.isBool {
+		return strconv.FormatBool(v.b)
+	}
+	return v.str
+}
+
+// conditionContext holds the data the condition expressions can refer to.
+type conditionContext struct {
+	vars      map[string]condValue
+	lookupEnv func(key string) (string, bool)
+}
+
+// conditionVariables are the variables available in the condition expressions, besides env.<KEY>.
+var conditionVariables = []string{"branch", "branch_dest", "tag", "pull_request_id", "commit", "commit_message", "parent_workflow", "is_pr", "is_tag"}
+
+// newConditionContext collects the variables from the parent build and its original build params.
+func newConditionContext(build bitrise.Build) conditionContext {
+	params := map[string]interface{}{}
+	decoder := json.NewDecoder(bytes.NewReader(build.OriginalBuildParams))
+	decoder.UseNumber()
+	if err := decoder.Decode(&params); err != nil {
+		log.Debugf("Failed to parse the original build params: %s", err)
+	}
+	param := func(key string) string {
+		if value, ok := params[key]; ok && value != nil {
+			return fmt.Sprint(value)
+		}
+		return ""
+	}
+
+	prID := param("pull_request_id")
+	tag := param("tag")
+	return conditionContext{
+		vars: map[string]condValue{
+			"branch":          {str: param("branch")},
+			"branch_dest":     {str: param("branch_dest")},
+			"tag":             {str: tag},
+			"pull_request_id": {str: prID},
+			"commit":          {str: param("commit_hash")},
+			"commit_message":  {str: param("commit_message")},
+			"parent_workflow": {str: build.TriggeredWorkflow},
+			"is_pr":           boolValue(prID != "" && prID != "0"),
+			"is_tag":          boolValue(tag != ""),
+		},
+		lookupEnv: os.LookupEnv,
+	}
+}
+
+// condition is a parsed condition expression.
+type condition interface {
+	eval(ctx conditionContext) (condValue, error)
+}
+
+type literalCondition struct{ value condValue }
+
+func (c literalCondition) eval(conditionContext) (condValue, error) {
+	return c.value, nil
+}
+
+type variableCondition struct{ name string }
+
+func (c variableCondition) eval(ctx conditionContext) (condValue, error) {
+	if strings.HasPrefix(c.name, "env.") {
+		value, _ := ctx.lookupEnv(strings.TrimPrefix(c.name, "env."))
+		return condValue{str: value}, nil
+	}
+	return ctx.vars[c.name], nil
+}
+
+type notCondition struct{ operand condition }
+
+func (c notCondition) eval(ctx conditionContext) (condValue, error) {
+	v, err := c.operand.eval(ctx)
+	if err != nil {
+		return condValue{}, err
+	}
+	return boolValue(!v.truthy()), nil
+}
+
+type logicalCondition struct {
+	op          string
+	left, right condition
+}
+
+func (c logicalCondition) eval(ctx conditionContext) (condValue, error) {
+	left, err := c.left.eval(ctx)
+	if err != nil {
+		return condValue{}, err
+	}
+	if c.op == "&&" && !left.truthy() || c.op == "||" && left.truthy() {
+		return boolValue(left.truthy()), nil
+	}
+	right, err := c.right.eval(ctx)
+	if err != nil {
+		return condValue{}, err
+	}
+	return boolValue(right.truthy()), nil
+}
+
+type comparisonCondition struct {
+	op          string
+	left, right condition
+	// regex is compiled at parse time if the right side of =~ or !~ is a literal.
+	regex *regexp.Regexp
+}
+
+func (c comparisonCondition) eval(ctx conditionContext) (condValue, error) {
+	left, err := c.left.eval(ctx)
+	if err != nil {
+		return condValue{}, err
+	}
+	right, err := c.right.eval(ctx)
+	if err != nil {
+		return condValue{}, err
+	}
+
+	switch c.op {
+	case "==":
+		return boolValue(left.String() == right.String()), nil
+	case "!=":
+		return boolValue(left.String() != right.String()), nil
+	}
+
+	re := c.regex
+	if re == nil {
+		if re, err = regexp.Compile(right.String()); err != nil {
+			return condValue{}, fmt.Errorf("invalid regular expression (%s): %s", right, err)
+		}
+	}
+	matched := re.MatchString(left.String())
+	if c.op == "!~" {
+		matched = !matched
+	}
+	return boolValue(matched), nil
+}
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenString
+	tokenOperator
+)
+
+type token struct {
+	kind  tokenKind
+	value string
+	pos   int
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case tokenEOF:
+		return "end of expression"
+	case tokenString:
+		return strconv.Quote(t.value)
+	default:
+		return t.value
+	}
+}
+
+var conditionOperators = []string{"&&", "||", "==", "!=", "=~", "!~", "!", "(", ")"}
+
+func isIdentChar(c byte) bool {
+	return c == '_' || c == '.' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+func tokenizeCondition(s string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+		case c == '"' || c == '\'':
+			var value strings.Builder
+			j := i + 1
+			for ; j < len(s) && s[j] != c; j++ {
+				if s[j] == '\\' && j+1 < len(s) && (s[j+1] == c || s[j+1] == '\\') {
+					j++
+				}
+				value.WriteByte(s[j])
+			}
+			if j == len(s) {
+				return nil, fmt.Errorf("unterminated string at position %d", i+1)
+			}
+			tokens = append(tokens, token{kind: tokenString, value: value.String(), pos: i + 1})
+			i = j + 1
+		case isIdentChar(c):
+			j := i
+			for j < len(s) && isIdentChar(s[j]) {
+				j++
+			}
+			tokens = append(tokens, token{kind: tokenIdent, value: s[i:j], pos: i + 1})
+			i = j
+		default:
+			op := ""
+			for _, candidate := range conditionOperators {
+				if strings.HasPrefix(s[i:], candidate) {
+					op = candidate
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("unexpected character %q at position %d", c, i+1)
+			}
+			tokens = append(tokens, token{kind: tokenOperator, value: op, pos: i + 1})
+			i += len(op)
+		}
+	}
+	return append(tokens, token{kind: tokenEOF, pos: len(s) + 1}), nil
+}
+
+// conditionParser is a recursive descent parser of the condition expressions:
+//
+//	expr       = and { "||" and }
+//	and        = unary { "&&" unary }
+//	unary      = "!" unary | comparison
+//	comparison = primary [ ( "==" | "!=" | "=~" | "!~" ) primary ]
+//	primary    = "(" expr ")" | string | "true" | "false" | variable
+type conditionParser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *conditionParser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *conditionParser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *conditionParser) acceptOperator(ops ...string) (string, bool) {
+	t := p.peek()
+	if t.kind != tokenOperator {
+		return "", false
+	}
+	for _, op := range ops {
+		if t.value == op {
+			p.next()
+			return op, true
+		}
+	}
+	return "", false
+}
+
+func (p *conditionParser) parseOr() (condition, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if _, ok := p.acceptOperator("||"); !ok {
+			return left, nil
+		}
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = logicalCondition{op: "||", left: left, right: right}
+	}
+}
+
+func (p *conditionParser) parseAnd() (condition, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if _, ok := p.acceptOperator("&&"); !ok {
+			return left, nil
+		}
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = logicalCondition{op: "&&", left: left, right: right}
+	}
+}
+
+func (p *conditionParser) parseUnary() (condition, error) {
+	if _, ok := p.acceptOperator("!"); ok {
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return notCondition{operand: operand}, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *conditionParser) parseComparison() (condition, error) {
+	left, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+
+	op, ok := p.acceptOperator("==", "!=", "=~", "!~")
+	if !ok {
+		return left, nil
+	}
+
+	rightToken := p.peek()
+	right, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+
+	c := comparisonCondition{op: op, left: left, right: right}
+	if literal, ok := right.(literalCondition); ok && (op == "=~" || op == "!~") {
+		re, err := regexp.Compile(literal.value.String())
+		if err != nil {
+			return nil, fmt.Errorf("invalid regular expression at position %d: %s", rightToken.pos, err)
+		}
+		c.regex = re
+	}
+	return c, nil
+}
+
+func (p *conditionParser) parsePrimary() (condition, error) {
+	t := p.next()
+	switch t.kind {
+	case tokenString:
+		return literalCondition{value: condValue{str: t.value}}, nil
+	case tokenIdent:
+		switch {
+		case t.value == "true" || t.value == "false":
+			return literalCondition{value: boolValue(t.value == "true")}, nil
+		case strings.HasPrefix(t.value, "env.") && envKeyRegexp.MatchString(strings.TrimPrefix(t.value, "env.")):
+			return variableCondition{name: t.value}, nil
+		case contains(conditionVariables, t.value):
+			return variableCondition{name: t.value}, nil
+		}
+		return nil, fmt.Errorf("unknown variable %s at position %d", t.value, t.pos)
+	case tokenOperator:
+		if t.value == "(" {
+			inner, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			if closing := p.next(); closing.kind != tokenOperator || closing.value != ")" {
+				return nil, fmt.Errorf("expected ) at position %d, found %s", closing.pos, closing)
+			}
+			return inner, nil
+		}
+	}
+	return nil, fmt.Errorf("unexpected %s at position %d", t, t.pos)
+}
+
+// parseCondition parses a condition expression, e.g. branch =~ "^release/" && !is_pr.
+func parseCondition(s string) (condition, error) {
+	tokens, err := tokenizeCondition(s)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &conditionParser{tokens: tokens}
+	c, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokenEOF {
+		return nil, fmt.Errorf("unexpected %s at position %d", t, t.pos)
+	}
+	return c, nil
+}
+
+// workflowCondition is a line of the workflow_conditions input: WORKFLOW: EXPRESSION.
+type workflowCondition struct {
+	workflow   string
+	expression string
+	condition  condition
+}
+
+func parseWorkflowConditions(s string) ([]workflowCondition, error) {
+	var conditions []workflowCondition
+	for _, line := range splitLines(s) {
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		split := strings.SplitN(line, ":", 2)
+		if len(split) != 2 || strings.TrimSpace(split[0]) == "" {
+			return nil, fmt.Errorf("invalid condition, expected WORKFLOW: EXPRESSION (%s)", line)
+		}
+
+		wc := workflowCondition{workflow: strings.TrimSpace(split[0]), expression: strings.TrimSpace(split[1])}
+		c, err := parseCondition(wc.expression)
+		if err != nil {
+			return nil, fmt.Errorf("invalid condition of %s (%s): %s", wc.workflow, wc.expression, err)
+		}
+		wc.condition = c
+		conditions = append(conditions, wc)
+	}
+	return conditions, nil
+}
+
+// selectWorkflowsByConditions includes the workflows whose conditions are all true,
+// workflows without a condition are always included.
+func selectWorkflowsByConditions(workflows []string, conditions []workflowCondition, ctx conditionContext) ([]workflowSelection, error) {
+	var selections []workflowSelection
+	for _, wf := range workflows {
+		selection := workflowSelection{Workflow: wf, Included: true, Reason: "no condition for the Workflow"}
+		for _, wc := range conditions {
+			if wc.workflow != wf {
+				continue
+			}
+
+			v, err := wc.condition.eval(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("failed to evaluate condition of %s (%s): %s", wf, wc.expression, err)
+			}
+			if !v.truthy() {
+				selection.Included = false
+				selection.Reason = fmt.Sprintf("condition is false: %s", wc.expression)
+				break
+			}
+			selection.Reason = fmt.Sprintf("condition is true: %s", wc.expression)
+		}
+		selections = append(selections, selection)
+	}
+	return selections, nil
+}
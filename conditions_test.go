@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/bitrise-steplib/bitrise-step-build-router-start/bitrise"
+	"github.com/stretchr/testify/require"
+)
+
+func testConditionContext() conditionContext {
+	ctx := newConditionContext(bitrise.Build{
+		TriggeredWorkflow:   "primary",
+		OriginalBuildParams: json.RawMessage(`{"branch": "release/1.2", "branch_dest": "main", "pull_request_id": 12, "commit_hash": "abc"}`),
+	})
+	ctx.lookupEnv = func(key string) (string, bool) {
+		if key == "RUN_UI_TESTS" {
+			return "true", true
+		}
+		return "", false
+	}
+	return ctx
+}
+
+func Test_parseCondition_eval(t *testing.T) {
+	tests := []struct {
+		expression string
+		want       bool
+	}{
+		{expression: `branch =~ "^release/"`, want: true},
+		{expression: `branch !~ '^release/'`, want: false},
+		{expression: `branch == "main"`, want: false},
+		{expression: `branch_dest == "main" && is_pr`, want: true},
+		{expression: `pull_request_id == "12"`, want: true},
+		{expression: `is_tag || tag`, want: false},
+		{expression: `!is_tag`, want: true},
+		{expression: `!(is_pr && commit == "abc")`, want: false},
+		{expression: `env.RUN_UI_TESTS == "true" && !env.MISSING`, want: true},
+		{expression: `parent_workflow == "primary" || false`, want: true},
+		{expression: `is_pr == true`, want: true},
+		{expression: `branch =~ branch_dest`, want: false},
+		{expression: `"a \"quoted\" string" == 'a "quoted" string'`, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expression, func(t *testing.T) {
+			c, err := parseCondition(tt.expression)
+			require.NoError(t, err)
+			got, err := c.eval(testConditionContext())
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got.truthy())
+		})
+	}
+}
+
+func Test_parseCondition_errors(t *testing.T) {
+	tests := []struct {
+		expression string
+		wantErr    string
+	}{
+		{expression: `branch ==`, wantErr: "unexpected end of expression at position 10"},
+		{expression: `(is_pr`, wantErr: "expected ) at position 7, found end of expression"},
+		{expression: `unknown == "x"`, wantErr: "unknown variable unknown at position 1"},
+		{expression: `branch == "x`, wantErr: "unterminated string at position 11"},
+		{expression: `branch = "x"`, wantErr: "unexpected character '=' at position 8"},
+		{expression: `branch =~ "["`, wantErr: "invalid regular expression at position 11: error parsing regexp: missing closing ]: `[`"},
+		{expression: `is_pr is_tag`, wantErr: "unexpected is_tag at position 7"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expression, func(t *testing.T) {
+			_, err := parseCondition(tt.expression)
+			require.EqualError(t, err, tt.wantErr)
+		})
+	}
+}
+
+func Test_selectWorkflowsByConditions(t *testing.T) {
+	conditions, err := parseWorkflowConditions("# comment\ndeploy: is_tag\nui-test: env.RUN_UI_TESTS == 'true'\n")
+	require.NoError(t, err)
+
+	got, err := selectWorkflowsByConditions([]string{"deploy", "ui-test", "unit"}, conditions, testConditionContext())
+	require.NoError(t, err)
+	require.Equal(t, []workflowSelection{
+		{Workflow: "deploy", Included: false, Reason: "condition is false: is_tag"},
+		{Workflow: "ui-test", Included: true, Reason: "condition is true: env.RUN_UI_TESTS == 'true'"},
+		{Workflow: "unit", Included: true, Reason: "no condition for the Workflow"},
+	}, got)
+
+	_, err = parseWorkflowConditions("deploy is_tag")
+	require.Error(t, err)
+	_, err = parseWorkflowConditions("deploy: is_tag &&")
+	require.Error(t, err)
+}
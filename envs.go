@@ -0,0 +1,374 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/log"
+	"github.com/bitrise-steplib/bitrise-step-build-router-start/bitrise"
+)
+
+const maxLoggedEnvValueLength = 64
+
+var (
+	secretKeyFragments = []string{"TOKEN", "SECRET", "PASS", "KEY", "CREDENTIAL", "AUTH", "PRIVATE", "CERT"}
+	reservedEnvKeys    = []string{bitrise.SourceBuildNumberEnvKey, bitrise.SourceBuildSlugEnvKey}
+	envKeyRegexp       = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+)
+
+// envPattern is a single line of the environment_key_list input.
+type envPattern struct {
+	workflows []string
+	exclude   bool
+	key       string
+	glob      string
+	regex     *regexp.Regexp
+
+	// target is the key the env is shared as, empty if it is shared with its own key.
+	target    string
+	isLiteral bool
+	literal   string
+}
+
+func (p envPattern) match(key string) bool {
+	switch {
+	case p.regex != nil:
+		return p.regex.MatchString(key)
+	case p.glob != "":
+		matched, err := path.Match(p.glob, key)
+		return err == nil && matched
+	default:
+		return p.key == key
+	}
+}
+
+func (p envPattern) isExact() bool {
+	return p.regex == nil && p.glob == ""
+}
+
+func (p envPattern) appliesTo(workflow string) bool {
+	if len(p.workflows) == 0 {
+		return true
+	}
+	for _, wf := range p.workflows {
+		if wf == workflow {
+			return true
+		}
+	}
+	return false
+}
+
+// parseEnvPattern parses an env key list line. Supported forms:
+//
+//	KEY or $KEY      exact key
+//	APP_*            glob pattern
+//	/^MATRIX_.*$/    regular expression
+//	TARGET=SOURCE    shares the value of SOURCE as TARGET
+//	TARGET:=literal  shares the literal value as TARGET
+//	!PATTERN         excludes the keys matched by any of the key, glob or regex forms
+//
+// Any of the forms can be prefixed with a comma separated workflow list, e.g. [wf1,wf2] TARGET=SOURCE,
+// to only share the env with the given workflows.
+func parseEnvPattern(line string) (envPattern, error) {
+	var p envPattern
+	if strings.HasPrefix(line, "[") {
+		end := strings.Index(line, "]")
+		if end == -1 {
+			return envPattern{}, fmt.Errorf("unclosed workflow list (%s)", line)
+		}
+		for _, wf := range strings.Split(line[1:end], ",") {
+			if wf = strings.TrimSpace(wf); wf != "" {
+				p.workflows = append(p.workflows, wf)
+			}
+		}
+		if len(p.workflows) == 0 {
+			return envPattern{}, fmt.Errorf("empty workflow list (%s)", line)
+		}
+		line = strings.TrimSpace(line[end+1:])
+	}
+
+	if strings.HasPrefix(line, "!") {
+		p.exclude = true
+		line = strings.TrimSpace(line[1:])
+	}
+
+	if len(line) > 1 && strings.HasPrefix(line, "/") && strings.HasSuffix(line, "/") {
+		re, err := regexp.Compile(line[1 : len(line)-1])
+		if err != nil {
+			return envPattern{}, fmt.Errorf("invalid regular expression (%s): %s", line, err)
+		}
+		p.regex = re
+		return p, nil
+	}
+
+	if !p.exclude {
+		if i := strings.Index(line, ":="); i != -1 {
+			p.target = strings.TrimSpace(line[:i])
+			p.isLiteral = true
+			p.literal = line[i+2:]
+			return p, validateTargetKey(p.target)
+		}
+
+		if i := strings.Index(line, "="); i != -1 {
+			p.target = strings.TrimSpace(line[:i])
+			p.key = strings.Replace(strings.TrimSpace(line[i+1:]), "$", "", -1)
+			if p.key == "" {
+				return envPattern{}, fmt.Errorf("empty source env key (%s)", line)
+			}
+			return p, validateTargetKey(p.target)
+		}
+	}
+
+	line = strings.Replace(line, "$", "", -1)
+	if line == "" {
+		return envPattern{}, fmt.Errorf("empty env key")
+	}
+
+	if strings.ContainsAny(line, "*?[") {
+		if _, err := path.Match(line, ""); err != nil {
+			return envPattern{}, fmt.Errorf("invalid glob pattern (%s): %s", line, err)
+		}
+		p.glob = line
+		return p, nil
+	}
+
+	p.key = line
+	if !p.exclude && isReservedEnvKey(p.key) {
+		return envPattern{}, reservedEnvKeyError(p.key)
+	}
+	return p, nil
+}
+
+func validateTargetKey(key string) error {
+	if !envKeyRegexp.MatchString(key) {
+		return fmt.Errorf("invalid env key (%s)", key)
+	}
+	if isReservedEnvKey(key) {
+		return reservedEnvKeyError(key)
+	}
+	return nil
+}
+
+func reservedEnvKeyError(key string) error {
+	return fmt.Errorf("env key (%s) is reserved, it is set by the Step for every started build", key)
+}
+
+func isReservedEnvKey(key string) bool {
+	for _, reserved := range reservedEnvKeys {
+		if key == reserved {
+			return true
+		}
+	}
+	return false
+}
+
+func parseEnvPatterns(environmentKeys string) ([]envPattern, error) {
+	var patterns []envPattern
+	for _, line := range strings.Split(environmentKeys, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		p, err := parseEnvPattern(line)
+		if err != nil {
+			return nil, err
+		}
+		patterns = append(patterns, p)
+	}
+	return patterns, nil
+}
+
+// sharedEnv describes where the value of a shared env comes from.
+type sharedEnv struct {
+	Target    string
+	Source    string
+	IsLiteral bool
+	Literal   string
+}
+
+// resolveEnvs expands the patterns, applying to the given workflow, against the available env keys.
+// Exact keys are kept even if they are not available, patterns only expand to available, non reserved keys.
+// If multiple patterns share an env with the same target key, the last one wins.
+func resolveEnvs(patterns []envPattern, workflow string, available []string) []sharedEnv {
+	sortedAvailable := append([]string{}, available...)
+	sort.Strings(sortedAvailable)
+
+	var envs []sharedEnv
+	indexByTarget := map[string]int{}
+	add := func(env sharedEnv) {
+		if i, ok := indexByTarget[env.Target]; ok {
+			envs[i] = env
+			return
+		}
+		indexByTarget[env.Target] = len(envs)
+		envs = append(envs, env)
+	}
+
+	for _, p := range patterns {
+		if p.exclude || !p.appliesTo(workflow) {
+			continue
+		}
+
+		switch {
+		case p.isLiteral:
+			add(sharedEnv{Target: p.target, IsLiteral: true, Literal: p.literal})
+		case p.target != "":
+			add(sharedEnv{Target: p.target, Source: p.key})
+		case p.isExact():
+			add(sharedEnv{Target: p.key, Source: p.key})
+		default:
+			for _, key := range sortedAvailable {
+				if p.match(key) && !isReservedEnvKey(key) {
+					add(sharedEnv{Target: key, Source: key})
+				}
+			}
+		}
+	}
+
+	var resolved []sharedEnv
+	for _, env := range envs {
+		if !isExcluded(patterns, workflow, env.Target) {
+			resolved = append(resolved, env)
+		}
+	}
+	return resolved
+}
+
+func isExcluded(patterns []envPattern, workflow, key string) bool {
+	for _, p := range patterns {
+		if p.exclude && p.appliesTo(workflow) && p.match(key) {
+			return true
+		}
+	}
+	return false
+}
+
+func environmentKeyList() []string {
+	var keys []string
+	for _, env := range os.Environ() {
+		key := strings.SplitN(env, "=", 2)[0]
+		if key != "" {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+const (
+	missingEnvWarn = "warn"
+	missingEnvSkip = "skip"
+	missingEnvFail = "fail"
+)
+
+// createEnvs resolves the envs shared with the given workflow.
+// missingEnvHandling decides what happens with envs which are not set in the current build:
+// they are shared with an empty value (warn), left out (skip) or reported as an error (fail).
+func createEnvs(environmentKeys, workflow, missingEnvHandling string) ([]bitrise.Environment, error) {
+	patterns, err := parseEnvPatterns(environmentKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	var environments []bitrise.Environment
+	var missingKeys []string
+	for _, shared := range resolveEnvs(patterns, workflow, environmentKeyList()) {
+		value := shared.Literal
+		if !shared.IsLiteral {
+			var ok bool
+			value, ok = os.LookupEnv(shared.Source)
+			if !ok {
+				missingKeys = append(missingKeys, shared.Source)
+
+				switch missingEnvHandling {
+				case missingEnvFail:
+					continue
+				case missingEnvSkip:
+					log.Warnf("Env %s is not set, not sharing it with %s", shared.Source, workflow)
+					continue
+				default:
+					log.Warnf("Env %s is not set, sharing %s with %s as an empty value", shared.Source, shared.Target, workflow)
+				}
+			}
+		}
+
+		env := bitrise.Environment{
+			MappedTo: shared.Target,
+			Value:    value,
+		}
+		environments = append(environments, env)
+	}
+
+	if missingEnvHandling == missingEnvFail && len(missingKeys) > 0 {
+		return nil, fmt.Errorf("envs to share with %s are not set: %s", workflow, strings.Join(missingKeys, ", "))
+	}
+	return environments, nil
+}
+
+func envSize(env bitrise.Environment) int {
+	return len(env.MappedTo) + len(env.Value)
+}
+
+// checkEnvsSize fails if the total size of the keys and values of the shared envs exceeds the limit (in bytes),
+// and prints the size of each env, largest first. A limit of 0 disables the check.
+func checkEnvsSize(workflow string, environments []bitrise.Environment, limit int) error {
+	total := 0
+	for _, env := range environments {
+		total += envSize(env)
+	}
+	log.Debugf("Envs shared with %s take %d bytes", workflow, total)
+
+	if limit <= 0 || total <= limit {
+		return nil
+	}
+
+	sorted := append([]bitrise.Environment{}, environments...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return envSize(sorted[i]) > envSize(sorted[j])
+	})
+
+	log.Warnf("Envs shared with %s take %d bytes, exceeding the limit of %d bytes:", workflow, total, limit)
+	for _, env := range sorted {
+		log.Warnf("- %s: %d bytes", env.MappedTo, envSize(env))
+	}
+	return fmt.Errorf("envs shared with %s exceed the size limit (%d > %d bytes)", workflow, total, limit)
+}
+
+func isSecretKey(key string) bool {
+	key = strings.ToUpper(key)
+	for _, fragment := range secretKeyFragments {
+		if strings.Contains(key, fragment) {
+			return true
+		}
+	}
+	return false
+}
+
+// printableEnvValue returns the value logged in debug mode, only the values of obviously secret keys are hidden,
+// as the Step can't tell which envs are secrets.
+func printableEnvValue(key, value string) string {
+	if isSecretKey(key) {
+		return "[REDACTED]"
+	}
+	if len(value) > maxLoggedEnvValueLength {
+		return value[:maxLoggedEnvValueLength] + "..."
+	}
+	return value
+}
+
+func logEnvs(workflow string, environments []bitrise.Environment) {
+	if len(environments) == 0 {
+		log.Printf("No envs shared with %s", workflow)
+		return
+	}
+
+	log.Printf("Envs shared with %s:", workflow)
+	for _, env := range environments {
+		log.Printf("- %s", env.MappedTo)
+		log.Debugf("  %s", printableEnvValue(env.MappedTo, env.Value))
+	}
+}
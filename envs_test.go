@@ -0,0 +1,196 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/bitrise-steplib/bitrise-step-build-router-start/bitrise"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_resolveEnvs_patterns(t *testing.T) {
+	available := []string{"APP_NAME", "APP_VERSION", "APP_SECRET", "FASTLANE_USER", "MATRIX_OS", "MATRIX_ARCH", "PATH"}
+
+	tests := []struct {
+		name            string
+		environmentKeys string
+		want            []string
+		wantErr         bool
+	}{
+		{
+			name:            "exact keys are kept even if not available",
+			environmentKeys: "PATH\n$MISSING",
+			want:            []string{"PATH", "MISSING"},
+		},
+		{
+			name:            "glob",
+			environmentKeys: "APP_*",
+			want:            []string{"APP_NAME", "APP_SECRET", "APP_VERSION"},
+		},
+		{
+			name:            "regex",
+			environmentKeys: "/^MATRIX_(OS|ARCH)$/",
+			want:            []string{"MATRIX_ARCH", "MATRIX_OS"},
+		},
+		{
+			name:            "exclusion",
+			environmentKeys: "APP_*\nFASTLANE_*\n!APP_SECRET",
+			want:            []string{"APP_NAME", "APP_VERSION", "FASTLANE_USER"},
+		},
+		{
+			name:            "exclusion with glob",
+			environmentKeys: "APP_*\n!*_SECRET\n$PATH",
+			want:            []string{"APP_NAME", "APP_VERSION", "PATH"},
+		},
+		{
+			name:            "duplicates are removed",
+			environmentKeys: "APP_NAME\nAPP_*",
+			want:            []string{"APP_NAME", "APP_SECRET", "APP_VERSION"},
+		},
+		{
+			name:            "invalid regex",
+			environmentKeys: "/(/",
+			wantErr:         true,
+		},
+		{
+			name:            "invalid glob",
+			environmentKeys: "APP_[",
+			wantErr:         true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			patterns, err := parseEnvPatterns(tt.environmentKeys)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			var got []string
+			for _, env := range resolveEnvs(patterns, "", available) {
+				got = append(got, env.Target)
+			}
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_resolveEnvs_mapping(t *testing.T) {
+	available := []string{"PARENT_VERSION", "APP_NAME", "SOURCE_BITRISE_BUILD_NUMBER"}
+
+	tests := []struct {
+		name            string
+		environmentKeys string
+		workflow        string
+		want            []sharedEnv
+		wantErr         bool
+	}{
+		{
+			name:            "remap",
+			environmentKeys: "VERSION=PARENT_VERSION\nNAME=$APP_NAME",
+			want: []sharedEnv{
+				{Target: "VERSION", Source: "PARENT_VERSION"},
+				{Target: "NAME", Source: "APP_NAME"},
+			},
+		},
+		{
+			name:            "literal",
+			environmentKeys: "CHANNEL:=beta=1 $HOME",
+			want:            []sharedEnv{{Target: "CHANNEL", IsLiteral: true, Literal: "beta=1 $HOME"}},
+		},
+		{
+			name:            "per workflow mapping",
+			environmentKeys: "APP_NAME\n[ios, android] VERSION=PARENT_VERSION\n[web] VERSION:=web",
+			workflow:        "web",
+			want: []sharedEnv{
+				{Target: "APP_NAME", Source: "APP_NAME"},
+				{Target: "VERSION", IsLiteral: true, Literal: "web"},
+			},
+		},
+		{
+			name:            "last mapping wins",
+			environmentKeys: "VERSION=PARENT_VERSION\nAPP_NAME\nVERSION:=1.0",
+			want: []sharedEnv{
+				{Target: "VERSION", IsLiteral: true, Literal: "1.0"},
+				{Target: "APP_NAME", Source: "APP_NAME"},
+			},
+		},
+		{
+			name:            "patterns skip reserved keys",
+			environmentKeys: "*",
+			want: []sharedEnv{
+				{Target: "APP_NAME", Source: "APP_NAME"},
+				{Target: "PARENT_VERSION", Source: "PARENT_VERSION"},
+			},
+		},
+		{
+			name:            "reserved key",
+			environmentKeys: "SOURCE_BITRISE_BUILD_NUMBER:=1",
+			wantErr:         true,
+		},
+		{
+			name:            "reserved key remap",
+			environmentKeys: "SOURCE_BITRISE_BUILD_NUMBER=PARENT_VERSION",
+			wantErr:         true,
+		},
+		{
+			name:            "invalid target",
+			environmentKeys: "MY-VERSION=PARENT_VERSION",
+			wantErr:         true,
+		},
+		{
+			name:            "unclosed workflow list",
+			environmentKeys: "[ios APP_NAME",
+			wantErr:         true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			patterns, err := parseEnvPatterns(tt.environmentKeys)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, resolveEnvs(patterns, tt.workflow, available))
+		})
+	}
+}
+
+func Test_printableEnvValue(t *testing.T) {
+	require.Equal(t, "[REDACTED]", printableEnvValue("GITHUB_TOKEN", "abc"))
+	require.Equal(t, "[REDACTED]", printableEnvValue("keystore_password", "abc"))
+	require.Equal(t, "1.0.0", printableEnvValue("APP_VERSION", "1.0.0"))
+}
+
+func Test_createEnvs_missingEnvHandling(t *testing.T) {
+	t.Setenv("ROUTER_TEST_EMPTY", "")
+	keys := "ROUTER_TEST_EMPTY\nROUTER_TEST_UNSET"
+
+	got, err := createEnvs(keys, "wf", missingEnvWarn)
+	require.NoError(t, err)
+	require.Equal(t, []bitrise.Environment{{MappedTo: "ROUTER_TEST_EMPTY"}, {MappedTo: "ROUTER_TEST_UNSET"}}, got)
+
+	got, err = createEnvs(keys, "wf", missingEnvSkip)
+	require.NoError(t, err)
+	require.Equal(t, []bitrise.Environment{{MappedTo: "ROUTER_TEST_EMPTY"}}, got)
+
+	_, err = createEnvs(keys, "wf", missingEnvFail)
+	require.EqualError(t, err, "envs to share with wf are not set: ROUTER_TEST_UNSET")
+
+	got, err = createEnvs("VALUE:=literal", "wf", missingEnvFail)
+	require.NoError(t, err)
+	require.Equal(t, []bitrise.Environment{{MappedTo: "VALUE", Value: "literal"}}, got)
+}
+
+func Test_checkEnvsSize(t *testing.T) {
+	envs := []bitrise.Environment{
+		{MappedTo: "SMALL", Value: "1"},
+		{MappedTo: "LARGE", Value: strings.Repeat("x", 100)},
+	}
+
+	require.NoError(t, checkEnvsSize("wf", envs, 0))
+	require.NoError(t, checkEnvsSize("wf", envs, 111))
+	require.Error(t, checkEnvsSize("wf", envs, 110))
+}
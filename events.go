@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/bitrise-io/go-utils/command"
+	"github.com/bitrise-io/go-utils/log"
+	"github.com/bitrise-steplib/bitrise-step-build-router-start/bitrise"
+)
+
+type eventType string
+
+// The lifecycle events of the routed builds.
+const (
+	eventStarted            eventType = "started"
+	eventReused             eventType = "reused"
+	eventStatusChanged      eventType = "status_changed"
+	eventFinished           eventType = "finished"
+	eventFailed             eventType = "failed"
+	eventRetried            eventType = "retried"
+	eventAborted            eventType = "aborted"
+	eventArtifactDownloaded eventType = "artifact_downloaded"
+	eventTimedOut           eventType = "timed_out"
+)
+
+// event describes a lifecycle transition of a routed build.
+type event struct {
+	Type        eventType           `json:"type"`
+	Time        time.Time           `json:"time"`
+	Workflow    string              `json:"workflow"`
+	BuildSlug   string              `json:"build_slug"`
+	BuildNumber int64               `json:"build_number,omitempty"`
+	BuildURL    string              `json:"build_url,omitempty"`
+	Status      bitrise.BuildStatus `json:"status"`
+	// Message holds event specific details, e.g. the title of the downloaded artifact or the abort reason.
+	Message string `json:"message,omitempty"`
+}
+
+func newEvent(t eventType, build routedBuild, message string) event {
+	return event{
+		Type:        t,
+		Time:        time.Now(),
+		Workflow:    build.Workflow,
+		BuildSlug:   build.Slug,
+		BuildNumber: build.BuildNumber,
+		BuildURL:    build.URL,
+		Status:      build.Status,
+		Message:     message,
+	}
+}
+
+// eventSink receives the published events.
+type eventSink interface {
+	handle(e event) error
+}
+
+// eventBus publishes the events to every subscribed sink, a failing sink doesn't fail the Step.
+type eventBus struct {
+	sinks []eventSink
+}
+
+func (b *eventBus) subscribe(sink eventSink) {
+	b.sinks = append(b.sinks, sink)
+}
+
+func (b *eventBus) publish(e event) {
+	for _, sink := range b.sinks {
+		if err := sink.handle(e); err != nil {
+			log.Warnf("Failed to handle %s event of %s: %s", e.Type, e.Workflow, err)
+		}
+	}
+}
+
+// ndjsonSink writes each event as a JSON line.
+type ndjsonSink struct {
+	w io.Writer
+}
+
+func (s ndjsonSink) handle(e event) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = s.w.Write(append(b, '\n'))
+	return err
+}
+
+// openNDJSONFileSink appends the events to the given file.
+func openNDJSONFileSink(pth string) (ndjsonSink, *os.File, error) {
+	f, err := os.OpenFile(pth, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return ndjsonSink{}, nil, err
+	}
+	return ndjsonSink{w: f}, f, nil
+}
+
+// commandHookSink runs a shell command on each event, the event is passed in ROUTER_EVENT_* envs.
+type commandHookSink struct {
+	command string
+}
+
+func eventEnvs(e event) ([]string, error) {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	return []string{
+		"ROUTER_EVENT_TYPE=" + string(e.Type),
+		"ROUTER_EVENT_TIME=" + e.Time.Format(time.RFC3339),
+		"ROUTER_EVENT_WORKFLOW=" + e.Workflow,
+		"ROUTER_EVENT_BUILD_SLUG=" + e.BuildSlug,
+		"ROUTER_EVENT_BUILD_NUMBER=" + strconv.FormatInt(e.BuildNumber, 10),
+		"ROUTER_EVENT_BUILD_URL=" + e.BuildURL,
+		"ROUTER_EVENT_STATUS=" + e.Status.String(),
+		"ROUTER_EVENT_MESSAGE=" + e.Message,
+		"ROUTER_EVENT_JSON=" + string(b),
+	}, nil
+}
+
+func (s commandHookSink) handle(e event) error {
+	envs, err := eventEnvs(e)
+	if err != nil {
+		return err
+	}
+
+	cmd := command.New("bash", "-c", s.command).AppendEnvs(envs...).SetStdout(os.Stdout).SetStderr(os.Stderr)
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("event hook failed: %s", err)
+	}
+	return nil
+}
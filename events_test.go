@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bitrise-steplib/bitrise-step-build-router-start/bitrise"
+	"github.com/stretchr/testify/require"
+)
+
+type recordingSink struct {
+	events []event
+	err    error
+}
+
+func (s *recordingSink) handle(e event) error {
+	s.events = append(s.events, e)
+	return s.err
+}
+
+func testEvent() event {
+	build := routedBuild{Workflow: "ui-test", Slug: "slug", BuildNumber: 12, URL: "https://app.bitrise.io/build/slug", Status: bitrise.BuildStatusFailed}
+	e := newEvent(eventFinished, build, "")
+	e.Time = time.Date(2022, 1, 1, 10, 0, 0, 0, time.UTC)
+	return e
+}
+
+func Test_eventBus_publish(t *testing.T) {
+	failing := &recordingSink{err: errors.New("sink error")}
+	recording := &recordingSink{}
+
+	bus := &eventBus{}
+	bus.subscribe(failing)
+	bus.subscribe(recording)
+	bus.publish(testEvent())
+
+	require.Len(t, failing.events, 1)
+	require.Equal(t, []event{testEvent()}, recording.events)
+}
+
+func Test_ndjsonSink(t *testing.T) {
+	var buf bytes.Buffer
+	sink := ndjsonSink{w: &buf}
+	require.NoError(t, sink.handle(testEvent()))
+	require.NoError(t, sink.handle(testEvent()))
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 2)
+	require.Equal(t, `{"type":"finished","time":"2022-01-01T10:00:00Z","workflow":"ui-test","build_slug":"slug","build_number":12,"build_url":"https://app.bitrise.io/build/slug","status":"error"}`, lines[0])
+
+	var decoded event
+	require.NoError(t, json.Unmarshal([]byte(lines[1]), &decoded))
+	require.Equal(t, testEvent(), decoded)
+}
+
+func Test_commandHookSink(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "hook.txt")
+	sink := commandHookSink{command: `echo "$ROUTER_EVENT_TYPE $ROUTER_EVENT_WORKFLOW $ROUTER_EVENT_BUILD_NUMBER $ROUTER_EVENT_STATUS" > "` + out + `"`}
+	require.NoError(t, sink.handle(testEvent()))
+
+	content, err := ioutil.ReadFile(out)
+	require.NoError(t, err)
+	require.Equal(t, "finished ui-test 12 error\n", string(content))
+
+	require.Error(t, commandHookSink{command: "exit 1"}.handle(testEvent()))
+}
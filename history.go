@@ -0,0 +1,81 @@
+package main
+
+import (
+	"sort"
+	"time"
+
+	"github.com/bitrise-io/go-utils/log"
+	"github.com/bitrise-steplib/bitrise-step-build-router-start/bitrise"
+)
+
+// historicalBuildsLimit is the number of recent successful builds the duration statistics of a workflow are based on.
+const historicalBuildsLimit = 20
+
+// durationStats describes how long the recent successful builds of a workflow took.
+type durationStats struct {
+	Median  time.Duration
+	P90     time.Duration
+	Samples int
+}
+
+// percentile returns the p-th percentile (0-100) of the durations using the nearest-rank method.
+func percentile(durations []time.Duration, p float64) time.Duration {
+	if len(durations) == 0 {
+		return 0
+	}
+
+	sorted := append([]time.Duration{}, durations...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i] < sorted[j]
+	})
+
+	rank := int(p/100*float64(len(sorted)) + 0.5)
+	if rank < 1 {
+		rank = 1
+	}
+	if rank > len(sorted) {
+		rank = len(sorted)
+	}
+	return sorted[rank-1]
+}
+
+func newDurationStats(builds []bitrise.Build) (durationStats, bool) {
+	var durations []time.Duration
+	for _, build := range builds {
+		if build.StartedOnWorkerAt == nil || build.FinishedAt == nil {
+			continue
+		}
+		durations = append(durations, build.FinishedAt.Sub(*build.StartedOnWorkerAt))
+	}
+	if len(durations) == 0 {
+		return durationStats{}, false
+	}
+	return durationStats{
+		Median:  percentile(durations, 50),
+		P90:     percentile(durations, 90),
+		Samples: len(durations),
+	}, true
+}
+
+// historicalDurations returns the duration statistics of the given workflows,
+// workflows without recent successful builds are left out.
+func historicalDurations(app bitrise.App, workflows []string) map[string]durationStats {
+	successful := bitrise.BuildStatusSuccessful
+	stats := map[string]durationStats{}
+	for _, wf := range workflows {
+		if _, ok := stats[wf]; ok {
+			continue
+		}
+
+		response, err := app.ListBuilds(bitrise.ListBuildsParams{Workflow: wf, Status: &successful, Limit: historicalBuildsLimit})
+		if err != nil {
+			log.Warnf("Failed to list recent builds of %s: %s", wf, err)
+			continue
+		}
+		if s, ok := newDurationStats(response.Builds); ok {
+			log.Debugf("%s took %s (median), %s (p90) over %d builds", wf, s.Median, s.P90, s.Samples)
+			stats[wf] = s
+		}
+	}
+	return stats
+}
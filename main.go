@@ -1,10 +1,14 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
+	"text/template"
+	"time"
 
 	"github.com/bitrise-io/go-steputils/stepconf"
 	"github.com/bitrise-io/go-steputils/tools"
@@ -14,25 +18,109 @@ import (
 
 const envBuildSlugs = "ROUTER_STARTED_BUILD_SLUGS"
 
+// stepVersion identifies the Step in the User-Agent of the API requests,
+// it can be set at build time with -ldflags "-X main.stepVersion=<version>".
+var stepVersion = "dev"
+
 // Config ...
 type Config struct {
 	AppSlug                string          `env:"BITRISE_APP_SLUG,required"`
 	BuildSlug              string          `env:"BITRISE_BUILD_SLUG,required"`
 	BuildNumber            string          `env:"BITRISE_BUILD_NUMBER,required"`
+	ParentBuildURL         string          `env:"BITRISE_BUILD_URL"`
 	AccessToken            stepconf.Secret `env:"access_token,required"`
+	APIBaseURL             string          `env:"api_base_url"`
+	AppBaseURL             string          `env:"app_base_url"`
+	HTTPProxy              stepconf.Secret `env:"http_proxy"`
+	CACertPath             string          `env:"ca_cert_path"`
+	ClientCertPath         string          `env:"client_cert_path"`
+	ClientKeyPath          string          `env:"client_key_path"`
+	RequestTimeout         int             `env:"request_timeout"`
+	ConnectTimeout         int             `env:"connect_timeout"`
 	WaitForBuilds          string          `env:"wait_for_builds"`
 	BuildArtifactsSavePath string          `env:"build_artifacts_save_path"`
 	AbortBuildsOnFail      string          `env:"abort_on_fail"`
-	Workflows              string          `env:"workflows,required"`
+	AbortScope             string          `env:"abort_scope,opt[all,stage,none]"`
+	AbortReason            string          `env:"abort_reason"`
+	AbortSkipNotifications string          `env:"abort_skip_notifications,opt[yes,no]"`
+	AbortWithSuccess       string          `env:"abort_with_success,opt[yes,no]"`
+	Workflows              string          `env:"workflows"`
+	Stages                 string          `env:"stages"`
+	BuildSlugs             string          `env:"build_slugs"`
+	ChildOutputsArtifact   string          `env:"child_outputs_artifact"`
 	Environments           string          `env:"environment_key_list"`
+	MissingEnvHandling     string          `env:"missing_env_handling,opt[warn,skip,fail]"`
+	EnvSizeLimit           int             `env:"env_size_limit"`
+	CancelSuperseded       string          `env:"cancel_superseded,opt[yes,no]"`
+	ReuseBuilds            string          `env:"reuse_builds,opt[yes,no]"`
+	ReuseMaxAge            float64         `env:"reuse_max_age"`
+	StateFilePath          string          `env:"state_file_path"`
+	Resume                 string          `env:"resume,opt[yes,no]"`
+	EventsFile             string          `env:"events_file"`
+	EventsToStdout         string          `env:"events_to_stdout,opt[yes,no]"`
+	EventHookCommand       string          `env:"event_hook_command"`
+	WebhookURLs            stepconf.Secret `env:"webhook_urls"`
+	WebhookOn              string          `env:"webhook_on,opt[completion,failure,both]"`
+	WebhookTemplate        string          `env:"webhook_template"`
+	SummaryDir             string          `env:"summary_dir"`
+	ProgressInterval       int             `env:"progress_interval"`
+	SlowBuildFactor        float64         `env:"slow_build_factor"`
+	HungBuildFactor        float64         `env:"hung_build_factor"`
+	HungBuildAction        string          `env:"hung_build_action,opt[abort,fail]"`
+	StartDelay             float64         `env:"start_delay"`
+	StartJitter            float64         `env:"start_jitter"`
+	StartRate              float64         `env:"start_rate"`
+	StartBurst             int             `env:"start_burst"`
+	RouterConfigPath       string          `env:"router_config_path"`
+	RouterConfig           string          `env:"router_config"`
+	WorkflowConditions     string          `env:"workflow_conditions"`
+	ChangedFilesRules      string          `env:"changed_files_rules"`
+	DiffBaseRef            string          `env:"diff_base_ref"`
+	SourceDir              string          `env:"BITRISE_SOURCE_DIR"`
 	IsVerboseLog           bool            `env:"verbose,required"`
 }
 
+// router starts the builds, or attaches to already started ones, and follows them until they finish.
+type router struct {
+	app    bitrise.App
+	cfg    Config
+	state  *routerState
+	events *eventBus
+	// policies are the per-workflow settings of the router config.
+	policies map[string]workflowPolicy
+
+	// parentBuildParams and workflowEnvs are kept to restart the failed builds.
+	parentBuildParams json.RawMessage
+	workflowEnvs      map[string][]bitrise.Environment
+	// reuser is set if the successful builds of the same commit are reused.
+	reuser *buildReuser
+	// abortReason renders the reason of the builds aborted on failure.
+	abortReason *template.Template
+	// historical holds the duration statistics of the workflows, fetched once per run.
+	historical map[string]durationStats
+	// pacer spreads the build starts of every stage and retry round, so the rate limit applies to the whole run.
+	pacer *startPacer
+}
+
 func failf(s string, a ...interface{}) {
 	log.Errorf(s, a...)
 	os.Exit(1)
 }
 
+func secondsToDuration(seconds float64) time.Duration {
+	return time.Duration(seconds * float64(time.Second))
+}
+
+func splitLines(s string) []string {
+	var lines []string
+	for _, line := range strings.Split(s, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
 func main() {
 	var cfg Config
 	if err := stepconf.Parse(&cfg); err != nil {
@@ -44,118 +132,707 @@ func main() {
 
 	log.SetEnableDebugLog(cfg.IsVerboseLog)
 
-	app := bitrise.NewAppWithDefaultURL(cfg.AppSlug, string(cfg.AccessToken))
+	var metrics *bitrise.Metrics
+	if cfg.IsVerboseLog {
+		metrics = bitrise.NewMetrics()
+	}
 
-	build, err := app.GetBuild(cfg.BuildSlug)
+	app, err := bitrise.NewApp(strings.TrimSpace(cfg.APIBaseURL), cfg.AppSlug, string(cfg.AccessToken), bitrise.ClientOptions{
+		ProxyURL:       strings.TrimSpace(string(cfg.HTTPProxy)),
+		CACertPath:     strings.TrimSpace(cfg.CACertPath),
+		ClientCertPath: strings.TrimSpace(cfg.ClientCertPath),
+		ClientKeyPath:  strings.TrimSpace(cfg.ClientKeyPath),
+		Timeout:        time.Duration(cfg.RequestTimeout) * time.Second,
+		ConnectTimeout: time.Duration(cfg.ConnectTimeout) * time.Second,
+		UserAgent:      fmt.Sprintf("%s/%s", bitrise.DefaultUserAgent, stepVersion),
+		Metrics:        metrics,
+	})
 	if err != nil {
-		failf("failed to get build, error: %s", err)
+		failf("Issue with an input: %s", err)
 	}
 
+	routerCfg, err := loadRouterConfig(cfg.RouterConfigPath, cfg.RouterConfig)
+	if err != nil {
+		failf("Issue with an input: %s", err)
+	}
+	var policies map[string]workflowPolicy
+	if routerCfg != nil {
+		if strings.TrimSpace(cfg.Workflows) != "" || strings.TrimSpace(cfg.Stages) != "" {
+			log.Warnf("Router config is given, the workflows and stages inputs are ignored")
+		}
+		policies = routerCfg.apply(&cfg)
+		if routerCfg.Wait != nil && routerCfg.Wait.PollInterval > 0 {
+			app.PollInterval = time.Duration(routerCfg.Wait.PollInterval) * time.Second
+		}
+	} else if strings.TrimSpace(cfg.Stages) != "" && strings.TrimSpace(cfg.Workflows) != "" {
+		// The router config sets both the workflows and the stages, only the inputs given by the user are checked.
+		log.Warnf("Stages are given, the workflows input is ignored")
+	}
+	stages := parseStages(cfg.Stages, cfg.Workflows)
+	attachedBuildSlugs := splitLines(cfg.BuildSlugs)
+	if len(stages) == 0 && len(attachedBuildSlugs) == 0 {
+		failf("Issue with an input: either workflows, stages or build_slugs is required")
+	}
+
+	abortReason, err := parseAbortReasonTemplate(cfg.AbortReason)
+	if err != nil {
+		failf("Issue with an input: invalid abort reason template: %s", err)
+	}
+
+	r := router{
+		app:         app,
+		cfg:         cfg,
+		events:      &eventBus{},
+		policies:    policies,
+		abortReason: abortReason,
+	}
+
+	if cfg.EventsFile != "" {
+		sink, f, err := openNDJSONFileSink(cfg.EventsFile)
+		if err != nil {
+			failf("Failed to open events file: %s", err)
+		}
+		defer func() {
+			if err := f.Close(); err != nil {
+				log.Warnf("Failed to close events file: %s", err)
+			}
+		}()
+		r.events.subscribe(sink)
+	}
+	if cfg.EventsToStdout == "yes" {
+		r.events.subscribe(ndjsonSink{w: os.Stdout})
+	}
+	if strings.TrimSpace(cfg.EventHookCommand) != "" {
+		r.events.subscribe(commandHookSink{command: cfg.EventHookCommand})
+	}
+
+	runErr := r.run(stages, attachedBuildSlugs)
+	printMetrics(metrics)
+	if runErr != nil {
+		log.Errorf("An error occurred: %s", runErr)
+		os.Exit(1)
+	}
+}
+
+// printMetrics prints the timing metrics of the API requests, if they were recorded.
+func printMetrics(metrics *bitrise.Metrics) {
+	if metrics == nil {
+		return
+	}
+	lines := metrics.Lines()
+	if len(lines) == 0 {
+		return
+	}
+
+	fmt.Println()
+	log.Infof("API requests:")
+	for _, line := range lines {
+		log.Printf("- %s", line)
+	}
+}
+
+func (r *router) newWebhookNotifier() (*webhookNotifier, error) {
+	urls := splitLines(string(r.cfg.WebhookURLs))
+	if len(urls) == 0 {
+		return nil, nil
+	}
+
+	tmpl, err := parseWebhookTemplate(r.cfg.WebhookTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("invalid webhook template: %s", err)
+	}
+
+	return &webhookNotifier{
+		urls:              urls,
+		on:                r.cfg.WebhookOn,
+		template:          tmpl,
+		client:            newWebhookClient(r.app),
+		parentBuildNumber: r.cfg.BuildNumber,
+		parentBuildURL:    r.parentBuildURL(),
+	}, nil
+}
+
+func (r *router) run(stages [][]string, attachedBuildSlugs []string) error {
+	notifier, err := r.newWebhookNotifier()
+	if err != nil {
+		return err
+	}
+
+	if len(attachedBuildSlugs) > 0 {
+		if len(stages) > 0 {
+			log.Warnf("Build slugs are given, the workflows input is ignored")
+		}
+		if err := r.attachBuilds(attachedBuildSlugs); err != nil {
+			return err
+		}
+		if err := r.exportStartedBuilds(); err != nil {
+			return err
+		}
+		return r.waitAndReport(notifier, func() error {
+			fmt.Println()
+			log.Infof("Waiting for builds:")
+			return r.waitForAllBuilds(r.state.buildSlugs())
+		})
+	}
+
+	stages, err = r.prepareBuilds(stages)
+	if err != nil {
+		return err
+	}
+
+	if len(stages) > 1 {
+		// Later stages can only be started once the earlier ones passed, so the Step always waits for the stages.
+		return r.waitAndReport(notifier, func() error {
+			return r.runStages(stages)
+		})
+	}
+
+	var buildSlugs []string
+	if len(stages) == 1 {
+		if buildSlugs, err = r.startStage(0, 0, stages[0]); err != nil {
+			return err
+		}
+	}
+	if err := r.exportStartedBuilds(); err != nil {
+		return err
+	}
+
+	if r.cfg.WaitForBuilds != "true" {
+		return nil
+	}
+	return r.waitAndReport(notifier, func() error {
+		fmt.Println()
+		log.Infof("Waiting for builds:")
+		return r.waitForAllBuilds(buildSlugs)
+	})
+}
+
+// exportStartedBuilds exports the per-workflow envs and the slugs of the routed builds.
+func (r *router) exportStartedBuilds() error {
+	for _, routed := range r.state.Builds {
+		if err := exportStartedBuild(*routed); err != nil {
+			return fmt.Errorf("failed to export environment variable, error: %s", err)
+		}
+	}
+	if err := tools.ExportEnvironmentWithEnvman(envBuildSlugs, strings.Join(r.state.buildSlugs(), "\n")); err != nil {
+		return fmt.Errorf("failed to export environment variable, error: %s", err)
+	}
+	return nil
+}
+
+// waitAndReport runs wait, then writes the summary and sends the completion webhooks.
+// The completion webhooks are skipped if waiting was interrupted, as the builds may still be running.
+func (r *router) waitAndReport(notifier *webhookNotifier, wait func() error) error {
+	if notifier != nil {
+		notifier.state = r.state
+		r.events.subscribe(notifier)
+	}
+
+	waitErr := wait()
+
+	if summaryDir := strings.TrimSpace(r.cfg.SummaryDir); summaryDir != "" {
+		fmt.Println()
+		if err := r.writeSummary(summaryDir); err != nil {
+			log.Warnf("Failed to write summary: %s", err)
+		}
+	}
+
+	var failedErr *bitrise.BuildsFailedError
+	if waitErr != nil && !errors.As(waitErr, &failedErr) {
+		return waitErr
+	}
+	if notifier != nil {
+		if err := notifier.notifyCompletion(); err != nil {
+			log.Warnf("Failed to send webhook: %s", err)
+		}
+	}
+	return waitErr
+}
+
+func (r *router) saveState() {
+	if err := r.state.save(); err != nil {
+		log.Warnf("Failed to save state file: %s", err)
+	}
+}
+
+// attachBuilds follows the given, already started builds instead of starting new ones.
+func (r *router) attachBuilds(buildSlugs []string) error {
+	log.Infof("Attaching to builds:")
+
+	var builds []bitrise.Build
+	var workflows []string
+	for _, buildSlug := range buildSlugs {
+		build, err := r.app.GetBuild(buildSlug)
+		if err != nil {
+			return fmt.Errorf("failed to get build (%s), error: %s", buildSlug, err)
+		}
+		builds = append(builds, build)
+		workflows = append(workflows, build.TriggeredWorkflow)
+	}
+
+	r.state = newRouterState("", r.cfg.BuildSlug, workflows)
+	envKeys := workflowEnvKeys(workflows)
+	for i, build := range builds {
+		routed := &routedBuild{
+			Workflow:    build.TriggeredWorkflow,
+			EnvKey:      envKeys[i],
+			Slug:        build.Slug,
+			BuildNumber: build.BuildNumber,
+			URL:         r.buildURL(build.Slug),
+			Attempt:     1,
+		}
+		r.state.Builds = append(r.state.Builds, routed)
+		log.Printf("- %s (%s)", routed.Workflow, routed.URL)
+	}
+	return nil
+}
+
+// prepareBuilds selects the workflows to start and creates the state, or resumes from the state file if requested.
+// It returns the stages of the selected workflows.
+func (r *router) prepareBuilds(stages [][]string) ([][]string, error) {
+	build, err := r.app.GetBuild(r.cfg.BuildSlug)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get build, error: %s", err)
+	}
+	r.parentBuildParams = build.OriginalBuildParams
+	r.workflowEnvs = map[string][]bitrise.Environment{}
+
+	if r.cfg.CancelSuperseded == "yes" {
+		if err := r.cancelSupersededBuilds(build); err != nil {
+			log.Warnf("Failed to cancel superseded builds: %s", err)
+		}
+	}
+
+	if r.cfg.ReuseBuilds == "yes" {
+		r.reuser = newBuildReuser(r.app, build, time.Duration(r.cfg.ReuseMaxAge*float64(time.Hour)))
+		if r.reuser.commitHash == "" {
+			log.Warnf("The commit of the build is unknown, builds are not reused")
+		}
+	}
+
+	selected, skipped, err := r.selectWorkflows(flattenStages(stages), build)
+	if err != nil {
+		return nil, err
+	}
+	stages = filterStages(stages, selected)
+	workflows := flattenStages(stages)
+
+	statePath := strings.TrimSpace(r.cfg.StateFilePath)
+	if statePath == "" {
+		statePath = defaultStatePath(r.cfg.BuildSlug)
+	}
+	r.state = newRouterState(statePath, r.cfg.BuildSlug, workflows)
+	if r.cfg.Resume == "yes" {
+		loadedState, err := loadRouterState(statePath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load state file: %s", err)
+		}
+		if loadedState == nil {
+			log.Printf("No state file found at %s, starting builds", statePath)
+		} else if !loadedState.canResume(r.cfg.BuildSlug, workflows) {
+			log.Warnf("State file at %s belongs to another build or Workflow list, starting builds", statePath)
+		} else {
+			log.Printf("Resuming from state file at %s", statePath)
+			r.state = loadedState
+		}
+	}
+	r.state.Skipped = skipped
+	return stages, nil
+}
+
+// startStage starts a build for each workflow of the stage, skipping the builds already in the state.
+// offset is the index of the first workflow of the stage in the workflows of all the stages,
+// stage is the 1-based number of the stage, 0 if the workflows are not split into stages.
+// It returns the slugs of the builds of the stage.
+func (r *router) startStage(stage, offset int, workflows []string) ([]string, error) {
+	for _, wf := range workflows {
+		environments, err := createEnvs(r.cfg.Environments, wf, r.cfg.MissingEnvHandling)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create shared envs: %s", err)
+		}
+		logEnvs(wf, environments)
+		if err := checkEnvsSize(wf, environments, r.cfg.EnvSizeLimit); err != nil {
+			return nil, fmt.Errorf("failed to create shared envs: %s", err)
+		}
+		r.workflowEnvs[wf] = environments
+	}
+	fmt.Println()
+
 	log.Infof("Starting builds:")
 
 	var buildSlugs []string
-	environments := createEnvs(cfg.Environments)
-	for _, wf := range strings.Split(strings.TrimSpace(cfg.Workflows), "\n") {
-		wf = strings.TrimSpace(wf)
-		startedBuild, err := app.StartBuild(wf, build.OriginalBuildParams, cfg.BuildNumber, environments)
+	envKeys := workflowEnvKeys(r.state.Workflows)
+	for j, wf := range workflows {
+		i := offset + j
+		if i < len(r.state.Builds) {
+			routed := r.state.Builds[i]
+			routed.Attempt++
+			buildSlugs = append(buildSlugs, routed.Slug)
+			log.Printf("- %s already started (%s)", routed.Workflow, routed.URL)
+			continue
+		}
+
+		if routed, err := r.reuseBuild(wf, envKeys[i], stage); err != nil {
+			log.Warnf("Failed to find a reusable build: %s", err)
+		} else if routed != nil {
+			buildSlugs = append(buildSlugs, routed.Slug)
+			continue
+		}
+
+		startedBuild, err := r.startBuild(wf)
 		if err != nil {
-			failf("Failed to start build, error: %s", err)
+			return nil, fmt.Errorf("failed to start build, error: %s", err)
 		}
 		if startedBuild.BuildSlug == "" {
-			failf("Build was not started. This could mean that manual build approval is enabled for this project and it's blocking this step from starting builds.")
+			return nil, fmt.Errorf("build was not started. This could mean that manual build approval is enabled for this project and it's blocking this step from starting builds")
+		}
+
+		routed := &routedBuild{
+			Workflow:    wf,
+			EnvKey:      envKeys[i],
+			Slug:        startedBuild.BuildSlug,
+			BuildNumber: int64(startedBuild.BuildNumber),
+			URL:         startedBuild.BuildURL,
+			Attempt:     1,
+			Stage:       stage,
 		}
-		buildSlugs = append(buildSlugs, startedBuild.BuildSlug)
-		log.Printf("- %s started (https://app.bitrise.io/build/%s)", startedBuild.TriggeredWorkflow, startedBuild.BuildSlug)
+		r.state.Builds = append(r.state.Builds, routed)
+		buildSlugs = append(buildSlugs, routed.Slug)
+		log.Printf("- %s started (%s)", startedBuild.TriggeredWorkflow, routed.URL)
+
+		r.saveState()
+		r.events.publish(newEvent(eventStarted, *routed, ""))
+	}
+
+	r.saveState()
+	return buildSlugs, nil
+}
+
+// reuseBuild adopts the successful build of the workflow on the same commit, if reusing builds is enabled.
+// It returns nil if no build was reused.
+func (r *router) reuseBuild(workflow, envKey string, stage int) (*routedBuild, error) {
+	if r.reuser == nil {
+		return nil, nil
 	}
 
-	if err := tools.ExportEnvironmentWithEnvman(envBuildSlugs, strings.Join(buildSlugs, "\n")); err != nil {
-		failf("Failed to export environment variable, error: %s", err)
+	build, err := r.reuser.find(workflow)
+	if err != nil || build == nil {
+		return nil, err
 	}
 
-	if cfg.WaitForBuilds != "true" {
-		return
+	routed := &routedBuild{
+		Workflow:    workflow,
+		EnvKey:      envKey,
+		Slug:        build.Slug,
+		BuildNumber: build.BuildNumber,
+		URL:         r.buildURL(build.Slug),
+		Attempt:     1,
+		Stage:       stage,
+		Reused:      true,
 	}
+	routed.update(*build)
+	r.state.Builds = append(r.state.Builds, routed)
+	log.Printf("- %s reused (%s)", workflow, routed.URL)
 
-	fmt.Println()
-	log.Infof("Waiting for builds:")
+	r.saveState()
+	r.events.publish(newEvent(eventReused, *routed, fmt.Sprintf("Reused build #%d of commit %s", build.BuildNumber, r.reuser.commitHash)))
+	return routed, nil
+}
+
+// startPacer returns the pacer of the build starts, creating it on the first call only.
+func (r *router) startPacer() *startPacer {
+	if r.pacer == nil {
+		r.pacer = newStartPacer(secondsToDuration(r.cfg.StartDelay), secondsToDuration(r.cfg.StartJitter), r.cfg.StartRate, r.cfg.StartBurst)
+	}
+	return r.pacer
+}
+
+// startBuild starts a build of the workflow once the pacer allows it, retrying if the API rate limited it.
+func (r *router) startBuild(workflow string) (bitrise.StartResponse, error) {
+	pacer := r.startPacer()
+	pacer.wait()
+
+	var startedBuild bitrise.StartResponse
+	err := pacer.retryRateLimited(func() error {
+		var err error
+		startedBuild, err = r.app.StartBuild(workflow, r.parentBuildParams, r.cfg.BuildNumber, r.startEnvs(workflow))
+		return err
+	})
+	if err == nil && startedBuild.BuildURL == "" {
+		startedBuild.BuildURL = r.buildURL(startedBuild.BuildSlug)
+	}
+	return startedBuild, err
+}
+
+// buildURL returns the URL of the build on the Bitrise website set by the app_base_url input.
+func (r *router) buildURL(buildSlug string) string {
+	return buildURL(r.cfg.AppBaseURL, buildSlug)
+}
+
+// parentBuildURL returns the URL of the build running the Step.
+func (r *router) parentBuildURL() string {
+	if r.cfg.ParentBuildURL != "" {
+		return r.cfg.ParentBuildURL
+	}
+	return r.buildURL(r.cfg.BuildSlug)
+}
+
+// startEnvs returns the envs shared with the build of the workflow, extended with the parent build slug.
+func (r *router) startEnvs(workflow string) []bitrise.Environment {
+	envs := append([]bitrise.Environment{}, r.workflowEnvs[workflow]...)
+	return append(envs, bitrise.Environment{MappedTo: bitrise.SourceBuildSlugEnvKey, Value: r.cfg.BuildSlug})
+}
+
+// waitForAllBuilds waits for the given builds, restarting the failed ones which have retries left.
+// It returns a *bitrise.BuildsFailedError if any of the builds failed, and its failure is not allowed.
+func (r *router) waitForAllBuilds(buildSlugs []string) error {
+	var waited []*routedBuild
+	for _, buildSlug := range buildSlugs {
+		if routed := r.state.findBuild(buildSlug); routed != nil {
+			waited = append(waited, routed)
+		}
+	}
+
+	for len(buildSlugs) > 0 {
+		_, err := r.waitForBuilds(buildSlugs)
+
+		var failedErr *bitrise.BuildsFailedError
+		if err != nil && !errors.As(err, &failedErr) {
+			return err
+		}
+
+		buildSlugs = nil
+		if failedErr != nil {
+			buildSlugs = r.retryFailedBuilds(failedErr.Failed)
+		}
+	}
+
+	var failed []bitrise.BuildResult
+	for _, routed := range waited {
+		if !routed.Status.IsFailure() {
+			continue
+		}
+		if r.policies[routed.Workflow].AllowFailure {
+			log.Warnf("%s %s, its failure is allowed", routed.Workflow, routed.Status)
+			continue
+		}
+		failed = append(failed, bitrise.BuildResult{Slug: routed.Slug, Workflow: routed.Workflow, Status: routed.Status})
+	}
+	if len(failed) > 0 {
+		return &bitrise.BuildsFailedError{Failed: failed}
+	}
+	return nil
+}
+
+// canRetry tells if the failed build is restarted. Aborted builds are not restarted.
+func (r *router) canRetry(routed routedBuild) bool {
+	_, started := r.workflowEnvs[routed.Workflow]
+	return started && routed.Status == bitrise.BuildStatusFailed && routed.Retries < r.policies[routed.Workflow].Retries
+}
+
+// toleratesFailure tells if the failure of the build doesn't fail the Step, so it doesn't trigger abort on fail.
+func (r *router) toleratesFailure(routed routedBuild) bool {
+	return r.policies[routed.Workflow].AllowFailure || r.canRetry(routed)
+}
+
+// retryFailedBuilds restarts the failed builds which have retries left and returns the slugs of the restarted builds.
+func (r *router) retryFailedBuilds(failed []bitrise.BuildResult) []string {
+	var buildSlugs []string
+	for _, result := range failed {
+		routed := r.state.findBuild(result.Slug)
+		if routed == nil || !r.canRetry(*routed) {
+			continue
+		}
+
+		startedBuild, err := r.startBuild(routed.Workflow)
+		if err != nil || startedBuild.BuildSlug == "" {
+			log.Warnf("Failed to restart %s: %v", routed.Workflow, err)
+			continue
+		}
+
+		failedSlug := routed.Slug
+		routed.retry(startedBuild)
+		log.Printf("- %s restarted (%s), retry %d of %d", routed.Workflow, routed.URL, routed.Retries, r.policies[routed.Workflow].Retries)
+
+		r.saveState()
+		r.events.publish(newEvent(eventRetried, *routed, "Restarted failed build "+failedSlug))
+		if err := exportStartedBuild(*routed); err != nil {
+			log.Warnf("failed to export environment variable, error: %s", err)
+		}
+		buildSlugs = append(buildSlugs, routed.Slug)
+	}
+
+	if len(buildSlugs) > 0 {
+		if err := tools.ExportEnvironmentWithEnvman(envBuildSlugs, strings.Join(r.state.buildSlugs(), "\n")); err != nil {
+			log.Warnf("failed to export environment variable, error: %s", err)
+		}
+		fmt.Println()
+		log.Infof("Waiting for restarted builds:")
+	}
+	return buildSlugs
+}
+
+// historicalDurations returns the duration statistics of the workflows, fetching them on the first call only,
+// so the retry rounds and stages don't list the recent builds again.
+func (r *router) historicalDurations() map[string]durationStats {
+	if r.historical == nil {
+		r.historical = historicalDurations(r.app, r.state.Workflows)
+	}
+	return r.historical
+}
+
+// waitForBuilds waits for the given builds, aborting the others on failure if requested,
+// and downloads the artifacts and outputs of the finished builds.
+func (r *router) waitForBuilds(buildSlugs []string) ([]bitrise.BuildResult, error) {
+
+	var progressCallback func([]bitrise.BuildResult) error
+	if r.cfg.ProgressInterval > 0 || r.cfg.SlowBuildFactor > 0 || r.cfg.HungBuildFactor > 0 {
+		historical := r.historicalDurations()
+		var reporter *progressReporter
+		if r.cfg.ProgressInterval > 0 {
+			reporter = newProgressReporter(time.Duration(r.cfg.ProgressInterval)*time.Second, historical, time.Now())
+		}
+		detector := newSlowBuildDetector(historical, r.cfg.SlowBuildFactor, r.cfg.HungBuildFactor)
+
+		progressCallback = func(results []bitrise.BuildResult) error {
+			now := time.Now()
+			if reporter != nil {
+				reporter.report(results, now)
+			}
+			if detector.enabled() {
+				return r.handleSlowBuilds(detector.check(results, now))
+			}
+			return nil
+		}
+	}
 
-	if err := app.WaitForBuilds(buildSlugs, func(build bitrise.Build) {
-		var failReason string
+	return r.app.WaitForBuildsWithProgress(buildSlugs, func(build bitrise.Build) {
 		switch build.Status {
-		case 0:
+		case bitrise.BuildStatusRunning:
 			log.Printf("- %s %s", build.TriggeredWorkflow, build.StatusText)
-		case 1:
+		case bitrise.BuildStatusSuccessful:
 			log.Donef("- %s successful", build.TriggeredWorkflow)
-		case 2:
+		case bitrise.BuildStatusFailed:
 			log.Errorf("- %s failed", build.TriggeredWorkflow)
-			failReason = "failed"
-		case 3:
+		case bitrise.BuildStatusAborted:
 			log.Warnf("- %s aborted", build.TriggeredWorkflow)
-			failReason = "aborted"
-		case 4:
-			log.Infof("- %s cancelled", build.TriggeredWorkflow)
-			failReason = "cancelled"
-		}
-
-		if cfg.AbortBuildsOnFail == "yes" && build.Status > 1 {
-			for _, buildSlug := range buildSlugs {
-				if buildSlug != build.Slug {
-					abortErr := app.AbortBuild(buildSlug, "Abort on Fail - Build [https://app.bitrise.io/build/"+build.Slug+"] "+failReason+"\nAuto aborted by parent build")
-					if abortErr != nil {
-						log.Warnf("failed to abort build, error: %s", abortErr)
-					}
-					log.Donef("Build " + buildSlug + " aborted due to associated build failure")
-				}
-			}
+		case bitrise.BuildStatusAbortedWithSuccess:
+			log.Donef("- %s aborted with success", build.TriggeredWorkflow)
+		default:
+			log.Warnf("- %s %s", build.TriggeredWorkflow, build.Status)
 		}
 
-		if build.Status != 0 {
-			buildArtifactSaveDir := strings.TrimSpace(cfg.BuildArtifactsSavePath)
-			if buildArtifactSaveDir != "" {
-				artifactsResponse, err := build.GetBuildArtifacts(app)
-				if err != nil {
-					log.Warnf("failed to get build artifacts: %s", err)
-				}
-				for _, artifactSlug := range artifactsResponse.ArtifactSlugs {
-					artifactObj, err := build.GetBuildArtifact(app, artifactSlug.ArtifactSlug)
-					if err != nil {
-						log.Warnf("failed to get build artifact: %s", err)
-						continue
-					}
-					if err = os.MkdirAll(buildArtifactSaveDir, 0777); err != nil {
-						log.Warnf("failed to ensure artifact path %s exists: %s", buildArtifactSaveDir, err)
-						continue
-					}
-					fullBuildArtifactsSavePath := filepath.Join(buildArtifactSaveDir, artifactObj.Artifact.Title)
-					downloadErr := artifactObj.Artifact.DownloadArtifact(fullBuildArtifactsSavePath)
-					if downloadErr != nil {
-						log.Warnf("failed to download %s artifact: %s", artifactObj.Artifact.Title, downloadErr)
-					} else {
-						log.Donef("Downloaded %s to %s", artifactObj.Artifact.Title, fullBuildArtifactsSavePath)
-					}
+		routed := r.state.findBuild(build.Slug)
+		if routed != nil {
+			routed.update(build)
+			r.saveState()
+			r.events.publish(newEvent(eventStatusChanged, *routed, build.StatusText))
+		}
+
+		if r.cfg.AbortBuildsOnFail == "yes" && build.Status.IsFailure() && (routed == nil || !r.toleratesFailure(*routed)) {
+			r.abortOnFail(build, buildSlugs)
+		}
+
+		if routed == nil || !build.Status.IsTerminal() {
+			return
+		}
+
+		r.events.publish(newEvent(eventFinished, *routed, ""))
+		if build.Status.IsFailure() && !r.toleratesFailure(*routed) {
+			r.events.publish(newEvent(eventFailed, *routed, ""))
+		}
+
+		if err := exportBuildStatus(*routed); err != nil {
+			log.Warnf("failed to export status of %s: %s", build.TriggeredWorkflow, err)
+		}
+
+		buildArtifactSaveDir := strings.TrimSpace(r.cfg.BuildArtifactsSavePath)
+		if buildArtifactSaveDir != "" {
+			r.downloadArtifacts(build, buildArtifactSaveDir, routed)
+		}
+
+		outputsArtifact := strings.TrimSpace(r.cfg.ChildOutputsArtifact)
+		if outputsArtifact != "" {
+			outputs, err := downloadChildOutputs(r.app, build, outputsArtifact)
+			if err != nil {
+				log.Warnf("failed to get outputs of %s: %s", build.TriggeredWorkflow, err)
+			} else if outputs == nil {
+				log.Debugf("%s has no %s artifact", build.TriggeredWorkflow, outputsArtifact)
+			} else {
+				log.Printf("Outputs of %s:", build.TriggeredWorkflow)
+				if err := exportChildOutputs(routed.EnvKey, outputs); err != nil {
+					log.Warnf("failed to export outputs of %s: %s", build.TriggeredWorkflow, err)
 				}
 			}
 		}
-	}); err != nil {
-		failf("An error occurred: %s", err)
-	}
+	}, progressCallback)
 }
 
-func createEnvs(environmentKeys string) []bitrise.Environment {
-	environmentKeys = strings.Replace(environmentKeys, "$", "", -1)
-	environmentsKeyList := strings.Split(environmentKeys, "\n")
+// handleSlowBuilds warns about the slow builds, and aborts the hung ones or stops waiting, depending on hung_build_action.
+func (r *router) handleSlowBuilds(slow, hung []slowBuild) error {
+	for _, b := range slow {
+		log.Warnf("- %s", b)
+	}
+
+	for _, b := range hung {
+		log.Errorf("- %s", b)
+
+		routed := r.state.findBuild(b.Slug)
+		if routed != nil {
+			r.events.publish(newEvent(eventTimedOut, *routed, b.String()))
+		}
+
+		if r.cfg.HungBuildAction == hungBuildActionFail {
+			return fmt.Errorf("build of %s is hung: %s", b.Workflow, b)
+		}
+
+		abortReason := fmt.Sprintf("Hung build - %s\nAuto aborted by parent build", b)
+		if err := r.app.AbortBuild(b.Slug, abortReason); err != nil {
+			log.Warnf("failed to abort build, error: %s", err)
+			continue
+		}
+		log.Donef("Build %s aborted as it is hung", b.Slug)
+		if routed != nil {
+			r.events.publish(newEvent(eventAborted, *routed, abortReason))
+		}
+	}
+	return nil
+}
 
-	var environments []bitrise.Environment
-	for _, key := range environmentsKeyList {
-		if key == "" {
+func (r *router) downloadArtifacts(build bitrise.Build, buildArtifactSaveDir string, routed *routedBuild) {
+	artifactsResponse, err := build.GetBuildArtifacts(r.app)
+	if err != nil {
+		log.Warnf("failed to get build artifacts: %s", err)
+	}
+	for _, artifactSlug := range artifactsResponse.ArtifactSlugs {
+		if artifactSlug.Title != "" && !r.policies[routed.Workflow].downloadsArtifact(artifactSlug.Title) {
+			log.Debugf("%s doesn't match the artifact filters of %s", artifactSlug.Title, routed.Workflow)
+			continue
+		}
+		if artifactSlug.Title != "" && routed.isArtifactDownloaded(artifactSlug.Title) {
+			log.Printf("%s already downloaded", artifactSlug.Title)
 			continue
 		}
 
-		env := bitrise.Environment{
-			MappedTo: key,
-			Value:    os.Getenv(key),
+		artifactObj, err := build.GetBuildArtifact(r.app, artifactSlug.ArtifactSlug)
+		if err != nil {
+			log.Warnf("failed to get build artifact: %s", err)
+			continue
+		}
+		if err = os.MkdirAll(buildArtifactSaveDir, 0777); err != nil {
+			log.Warnf("failed to ensure artifact path %s exists: %s", buildArtifactSaveDir, err)
+			continue
 		}
-		environments = append(environments, env)
+		fullBuildArtifactsSavePath := filepath.Join(buildArtifactSaveDir, artifactObj.Artifact.Title)
+		downloadErr := artifactObj.Artifact.DownloadArtifact(r.app, fullBuildArtifactsSavePath)
+		if downloadErr != nil {
+			log.Warnf("failed to download %s artifact: %s", artifactObj.Artifact.Title, downloadErr)
+			continue
+		}
+
+		log.Donef("Downloaded %s to %s", artifactObj.Artifact.Title, fullBuildArtifactsSavePath)
+		routed.DownloadedArtifacts = append(routed.DownloadedArtifacts, artifactObj.Artifact.Title)
+		r.saveState()
+		r.events.publish(newEvent(eventArtifactDownloaded, *routed, fullBuildArtifactsSavePath))
 	}
-	return environments
 }
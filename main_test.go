@@ -1,8 +1,14 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/bitrise-steplib/bitrise-step-build-router-start/bitrise"
 )
@@ -70,9 +76,142 @@ func Test_createEnvs(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if got := createEnvs(tt.environmentKeys); !reflect.DeepEqual(got, tt.want) {
+			got, err := createEnvs(tt.environmentKeys, "", missingEnvFail)
+			if err != nil {
+				t.Fatalf("createEnvs() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
 				t.Errorf("createEnvs() = %v, want %v", got, tt.want)
 			}
 		})
 	}
 }
+
+func Test_splitLines(t *testing.T) {
+	got := splitLines(" wf1\n\n  wf2 \n")
+	if !reflect.DeepEqual(got, []string{"wf1", "wf2"}) {
+		t.Errorf("splitLines() = %v", got)
+	}
+}
+
+func Test_attachBuilds(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v0.1/apps/app/builds/slug1":
+			fmt.Fprint(w, `{"data": {"slug": "slug1", "build_number": 11, "triggered_workflow": "ui-test"}}`)
+		case "/v0.1/apps/app/builds/slug2":
+			fmt.Fprint(w, `{"data": {"slug": "slug2", "build_number": 12, "triggered_workflow": "ui-test"}}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	app := bitrise.App{BaseURL: server.URL, Slug: "app", AccessToken: "token", IsDebugRetryTimings: true}
+	r := router{app: app, cfg: Config{BuildSlug: "parent"}, events: &eventBus{}}
+	if err := r.attachBuilds([]string{"slug1", "slug2"}); err != nil {
+		t.Fatalf("attachBuilds() error = %v", err)
+	}
+	state := r.state
+
+	want := []*routedBuild{
+		{Workflow: "ui-test", EnvKey: "UI_TEST", Slug: "slug1", BuildNumber: 11, URL: "https://app.bitrise.io/build/slug1", Attempt: 1},
+		{Workflow: "ui-test", EnvKey: "UI_TEST_2", Slug: "slug2", BuildNumber: 12, URL: "https://app.bitrise.io/build/slug2", Attempt: 1},
+	}
+	if !reflect.DeepEqual(state.Builds, want) {
+		t.Errorf("attachBuilds() = %v, want %v", state.Builds, want)
+	}
+}
+
+func Test_waitForAllBuilds_retries(t *testing.T) {
+	started, rateLimited := 0, 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v0.1/apps/app/builds":
+			if rateLimited == 0 {
+				// the first restart is rate limited, it is retried by the start pacer
+				rateLimited++
+				w.Header().Set("Retry-After", "0")
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+			started++
+			fmt.Fprintf(w, `{"status": "ok", "build_slug": "retry%d", "build_number": %d, "triggered_workflow": "ui-test"}`, started, 20+started)
+		case "/v0.1/apps/app/builds/slug1", "/v0.1/apps/app/builds/retry1":
+			fmt.Fprintf(w, `{"data": {"slug": "%s", "status": 2, "status_text": "error", "triggered_workflow": "ui-test"}}`, path.Base(r.URL.Path))
+		case "/v0.1/apps/app/builds/retry2":
+			fmt.Fprint(w, `{"data": {"slug": "retry2", "status": 1, "status_text": "success", "triggered_workflow": "ui-test"}}`)
+		case "/v0.1/apps/app/builds/lint1":
+			fmt.Fprint(w, `{"data": {"slug": "lint1", "status": 2, "status_text": "error", "triggered_workflow": "lint"}}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	sink := &recordingSink{}
+	r := router{
+		app:    bitrise.App{BaseURL: server.URL, Slug: "app", AccessToken: "token", IsDebugRetryTimings: true, PollInterval: time.Millisecond},
+		cfg:    Config{AbortBuildsOnFail: "yes"},
+		events: &eventBus{},
+		state: &routerState{Builds: []*routedBuild{
+			{Workflow: "ui-test", Slug: "slug1"},
+			{Workflow: "lint", Slug: "lint1"},
+		}},
+		policies: map[string]workflowPolicy{
+			"ui-test": {Retries: 2},
+			"lint":    {AllowFailure: true},
+		},
+		parentBuildParams: json.RawMessage(`{"branch": "main"}`),
+		workflowEnvs:      map[string][]bitrise.Environment{"ui-test": nil, "lint": nil},
+	}
+	r.events.subscribe(sink)
+	// the retry rounds share the pacer: the second restart waits for the rate limit of 30 starts per minute
+	pacer, sleeps := newTestPacer(0, 0, 30, 1)
+	r.pacer = pacer
+
+	if err := r.waitForAllBuilds(r.state.buildSlugs()); err != nil {
+		t.Fatalf("waitForAllBuilds() error = %v", err)
+	}
+	if !reflect.DeepEqual(*sleeps, []time.Duration{2 * time.Second}) {
+		t.Errorf("pacer sleeps = %v", *sleeps)
+	}
+
+	retried := r.state.Builds[0]
+	if retried.Slug != "retry2" || retried.Retries != 2 || !reflect.DeepEqual(retried.PreviousSlugs, []string{"slug1", "retry1"}) {
+		t.Errorf("retried build = %+v", retried)
+	}
+	if retried.Status != bitrise.BuildStatusSuccessful {
+		t.Errorf("retried build status = %s", retried.Status)
+	}
+
+	countEvents := func(t eventType) int {
+		count := 0
+		for _, e := range sink.events {
+			if e.Type == t {
+				count++
+			}
+		}
+		return count
+	}
+	retriedEvents, abortedEvents := countEvents(eventRetried), countEvents(eventAborted)
+	if rateLimited != 1 || started != 2 {
+		t.Errorf("rate limited restarts = %d, restarts = %d", rateLimited, started)
+	}
+	if retriedEvents != 2 || abortedEvents != 0 {
+		t.Errorf("retried events = %d, aborted events = %d", retriedEvents, abortedEvents)
+	}
+	// retried and allowed failures don't fail the Step
+	if failedEvents := countEvents(eventFailed); failedEvents != 0 {
+		t.Errorf("failed events = %d, want 0", failedEvents)
+	}
+
+	r.policies["lint"] = workflowPolicy{}
+	err := r.waitForAllBuilds(r.state.buildSlugs())
+	if err == nil || err.Error() != "1 build failed or aborted: lint (lint1) error" {
+		t.Errorf("waitForAllBuilds() error = %v", err)
+	}
+	if failedEvents := countEvents(eventFailed); failedEvents != 1 {
+		t.Errorf("failed events = %d, want 1", failedEvents)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/bitrise-io/go-steputils/tools"
+	"github.com/bitrise-io/go-utils/log"
+	"github.com/bitrise-steplib/bitrise-step-build-router-start/bitrise"
+)
+
+const childOutputEnvPrefix = "ROUTER_OUT_"
+
+var invalidEnvKeyCharRegexp = regexp.MustCompile(`[^A-Z0-9_]`)
+
+// sanitizeEnvKey converts the given name (e.g. a workflow ID) into an upper-case env key fragment.
+func sanitizeEnvKey(name string) string {
+	return invalidEnvKeyCharRegexp.ReplaceAllString(strings.ToUpper(name), "_")
+}
+
+// parseChildOutputs parses the outputs artifact of a child build.
+// Files with .json extension are expected to hold a flat JSON object, any other file is parsed as a dotenv file.
+func parseChildOutputs(name string, content []byte) (map[string]string, error) {
+	if strings.EqualFold(filepath.Ext(name), ".json") {
+		return parseJSONOutputs(content)
+	}
+	return parseDotenvOutputs(string(content))
+}
+
+func parseJSONOutputs(content []byte) (map[string]string, error) {
+	var raw map[string]interface{}
+	if err := json.Unmarshal(content, &raw); err != nil {
+		return nil, fmt.Errorf("failed to parse JSON outputs: %s", err)
+	}
+
+	outputs := map[string]string{}
+	for key, value := range raw {
+		switch v := value.(type) {
+		case string:
+			outputs[key] = v
+		case nil:
+			outputs[key] = ""
+		case float64, bool:
+			outputs[key] = fmt.Sprint(v)
+		default:
+			b, err := json.Marshal(v)
+			if err != nil {
+				return nil, fmt.Errorf("failed to encode output (%s): %s", key, err)
+			}
+			outputs[key] = string(b)
+		}
+	}
+	return outputs, nil
+}
+
+func parseDotenvOutputs(content string) (map[string]string, error) {
+	outputs := map[string]string{}
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimSpace(strings.TrimPrefix(line, "export "))
+
+		split := strings.SplitN(line, "=", 2)
+		if len(split) != 2 || strings.TrimSpace(split[0]) == "" {
+			return nil, fmt.Errorf("invalid dotenv line %d: %s", lineNumber, line)
+		}
+
+		value := strings.TrimSpace(split[1])
+		if len(value) > 1 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		outputs[strings.TrimSpace(split[0])] = value
+	}
+	return outputs, scanner.Err()
+}
+
+// downloadChildOutputs downloads and parses the outputs artifact of the given build.
+// It returns nil if the build has no artifact with the given title.
+func downloadChildOutputs(app bitrise.App, build bitrise.Build, artifactTitle string) (map[string]string, error) {
+	artifactsResponse, err := build.GetBuildArtifacts(app)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get build artifacts: %s", err)
+	}
+
+	for _, artifactSlug := range artifactsResponse.ArtifactSlugs {
+		if artifactSlug.Title != artifactTitle {
+			continue
+		}
+
+		artifactObj, err := build.GetBuildArtifact(app, artifactSlug.ArtifactSlug)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get build artifact: %s", err)
+		}
+
+		tmpDir, err := ioutil.TempDir("", "router-outputs")
+		if err != nil {
+			return nil, err
+		}
+		defer func() {
+			if err := os.RemoveAll(tmpDir); err != nil {
+				log.Warnf("Failed to remove temporary directory: %s", err)
+			}
+		}()
+
+		pth := filepath.Join(tmpDir, artifactTitle)
+		if err := artifactObj.Artifact.DownloadArtifact(app, pth); err != nil {
+			return nil, fmt.Errorf("failed to download %s artifact: %s", artifactTitle, err)
+		}
+
+		content, err := ioutil.ReadFile(pth)
+		if err != nil {
+			return nil, err
+		}
+		return parseChildOutputs(artifactTitle, content)
+	}
+	return nil, nil
+}
+
+// exportChildOutputs exports the outputs of a child build as ROUTER_OUT_<WORKFLOW>_<KEY> envs.
+// The envs are set in the current process too, so they can be shared with builds started later by the Step.
+func exportChildOutputs(workflowKey string, outputs map[string]string) error {
+	var keys []string
+	for key := range outputs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		envKey := childOutputEnvPrefix + workflowKey + "_" + sanitizeEnvKey(key)
+		if err := tools.ExportEnvironmentWithEnvman(envKey, outputs[key]); err != nil {
+			return fmt.Errorf("failed to export %s: %s", envKey, err)
+		}
+		if err := os.Setenv(envKey, outputs[key]); err != nil {
+			return fmt.Errorf("failed to set %s: %s", envKey, err)
+		}
+		log.Printf("  %s", envKey)
+		log.Debugf("    %s", printableEnvValue(key, outputs[key]))
+	}
+	return nil
+}
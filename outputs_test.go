@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bitrise-steplib/bitrise-step-build-router-start/bitrise"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_sanitizeEnvKey(t *testing.T) {
+	require.Equal(t, "UI_TEST_IOS", sanitizeEnvKey("ui-test.ios"))
+	require.Equal(t, "DEPLOY_2", sanitizeEnvKey("deploy_2"))
+}
+
+func Test_parseChildOutputs(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		want    map[string]string
+		wantErr bool
+	}{
+		{
+			name:    "json",
+			file:    "router-outputs.json",
+			content: `{"VERSION": "1.2.3", "COUNT": 3, "OK": true, "EMPTY": null, "LIST": [1, 2]}`,
+			want:    map[string]string{"VERSION": "1.2.3", "COUNT": "3", "OK": "true", "EMPTY": "", "LIST": "[1,2]"},
+		},
+		{
+			name:    "invalid json",
+			file:    "router-outputs.json",
+			content: `["VERSION"]`,
+			wantErr: true,
+		},
+		{
+			name:    "dotenv",
+			file:    "router-outputs.env",
+			content: "# comment\nVERSION=1.2.3\nexport NAME=\"my app\"\n\nURL='https://a.b/?c=d'\n",
+			want:    map[string]string{"VERSION": "1.2.3", "NAME": "my app", "URL": "https://a.b/?c=d"},
+		},
+		{
+			name:    "invalid dotenv",
+			file:    "router-outputs.env",
+			content: "VERSION",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseChildOutputs(tt.file, []byte(tt.content))
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_downloadChildOutputs(t *testing.T) {
+	var serverURL string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v0.1/apps/app/builds/build/artifacts":
+			fmt.Fprint(w, `{"data": [{"slug": "a1", "title": "app.ipa"}, {"slug": "a2", "title": "router-outputs.env"}]}`)
+		case "/v0.1/apps/app/builds/build/artifacts/a2":
+			fmt.Fprintf(w, `{"data": {"title": "router-outputs.env", "expiring_download_url": "%s/download/a2"}}`, serverURL)
+		case "/download/a2":
+			fmt.Fprint(w, "VERSION=1.2.3\n")
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	serverURL = server.URL
+
+	app := bitrise.App{BaseURL: server.URL, Slug: "app", AccessToken: "token", IsDebugRetryTimings: true}
+	build := bitrise.Build{Slug: "build"}
+
+	outputs, err := downloadChildOutputs(app, build, "router-outputs.env")
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"VERSION": "1.2.3"}, outputs)
+
+	outputs, err = downloadChildOutputs(app, build, "missing.json")
+	require.NoError(t, err)
+	require.Nil(t, outputs)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"time"
+
+	"github.com/bitrise-io/go-utils/log"
+	"github.com/bitrise-steplib/bitrise-step-build-router-start/bitrise"
+)
+
+const (
+	// maxRateLimitedStarts is the number of times starting a build is retried after the API rate limited it.
+	maxRateLimitedStarts = 5
+	// defaultRateLimitWait is used if a rate limited response has no valid Retry-After header.
+	defaultRateLimitWait = time.Minute
+	// maxRateLimitWait caps the wait requested by the Retry-After header, so a bogus header can't stall the Step.
+	maxRateLimitWait = 5 * time.Minute
+)
+
+// tokenBucket allows rate events per second on average, with bursts of up to capacity events.
+type tokenBucket struct {
+	capacity float64
+	rate     float64
+	tokens   float64
+	last     time.Time
+}
+
+func newTokenBucket(ratePerMinute float64, capacity int, now time.Time) *tokenBucket {
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &tokenBucket{
+		capacity: float64(capacity),
+		rate:     ratePerMinute / 60,
+		tokens:   float64(capacity),
+		last:     now,
+	}
+}
+
+// take consumes a token and returns how long to wait before the event is allowed.
+func (b *tokenBucket) take(now time.Time) time.Duration {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.capacity {
+		b.tokens = b.capacity
+	}
+	b.last = now
+
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// startPacer spreads the build starts over time:
+// a fixed delay and a random jitter between two starts, and optionally a token bucket rate limit.
+type startPacer struct {
+	delay  time.Duration
+	jitter time.Duration
+	bucket *tokenBucket
+
+	started int
+	now     func() time.Time
+	sleep   func(time.Duration)
+	random  func(n int64) int64
+}
+
+func newStartPacer(delay, jitter time.Duration, ratePerMinute float64, burst int) *startPacer {
+	p := &startPacer{
+		delay:  delay,
+		jitter: jitter,
+		now:    time.Now,
+		sleep:  time.Sleep,
+		random: rand.Int63n,
+	}
+	if ratePerMinute > 0 {
+		p.bucket = newTokenBucket(ratePerMinute, burst, p.now())
+	}
+	return p
+}
+
+// wait blocks until the next build can be started.
+func (p *startPacer) wait() {
+	var wait time.Duration
+	if p.started > 0 {
+		wait = p.delay
+		if p.jitter > 0 {
+			wait += time.Duration(p.random(int64(p.jitter) + 1))
+		}
+	}
+	p.started++
+
+	if p.bucket != nil {
+		if rateWait := p.bucket.take(p.now().Add(wait)); rateWait > 0 {
+			wait += rateWait
+		}
+	}
+
+	if wait > 0 {
+		log.Debugf("Waiting %s before starting the next build", wait.Round(time.Millisecond))
+		p.sleep(wait)
+	}
+}
+
+// retryRateLimited calls start, and calls it again after the requested wait if the API rate limited it.
+func (p *startPacer) retryRateLimited(start func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := start()
+
+		var rateLimitErr *bitrise.RateLimitError
+		if !errors.As(err, &rateLimitErr) || attempt > maxRateLimitedStarts {
+			return err
+		}
+
+		wait := rateLimitErr.RetryAfter
+		if !rateLimitErr.HasRetryAfter {
+			wait = defaultRateLimitWait
+		} else if wait > maxRateLimitWait {
+			wait = maxRateLimitWait
+		}
+		log.Warnf("Rate limited by the API, retrying in %s", wait)
+		if wait > 0 {
+			p.sleep(wait)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/bitrise-steplib/bitrise-step-build-router-start/bitrise"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestPacer(delay, jitter time.Duration, ratePerMinute float64, burst int) (*startPacer, *[]time.Duration) {
+	clock := time.Date(2020, 1, 1, 10, 0, 0, 0, time.UTC)
+	var sleeps []time.Duration
+
+	p := newStartPacer(delay, jitter, 0, 0)
+	p.now = func() time.Time { return clock }
+	p.sleep = func(d time.Duration) {
+		sleeps = append(sleeps, d)
+		clock = clock.Add(d)
+	}
+	p.random = func(n int64) int64 { return n - 1 }
+	if ratePerMinute > 0 {
+		p.bucket = newTokenBucket(ratePerMinute, burst, clock)
+	}
+	return p, &sleeps
+}
+
+func Test_startPacer_wait(t *testing.T) {
+	p, sleeps := newTestPacer(2*time.Second, time.Second, 0, 0)
+	for i := 0; i < 3; i++ {
+		p.wait()
+	}
+	require.Equal(t, []time.Duration{3 * time.Second, 3 * time.Second}, *sleeps)
+
+	p, sleeps = newTestPacer(0, 0, 30, 2)
+	for i := 0; i < 4; i++ {
+		p.wait()
+	}
+	require.Equal(t, []time.Duration{2 * time.Second, 2 * time.Second}, *sleeps)
+}
+
+func Test_router_startPacer(t *testing.T) {
+	r := router{cfg: Config{StartRate: 30, StartBurst: 2}}
+	p := r.startPacer()
+	require.NotNil(t, p.bucket)
+	require.Same(t, p, r.startPacer())
+}
+
+func Test_tokenBucket_take(t *testing.T) {
+	now := time.Date(2020, 1, 1, 10, 0, 0, 0, time.UTC)
+	b := newTokenBucket(60, 1, now)
+	require.Equal(t, time.Duration(0), b.take(now))
+	require.Equal(t, time.Second, b.take(now))
+	require.Equal(t, time.Duration(0), b.take(now.Add(5*time.Second)))
+}
+
+func Test_startPacer_retryRateLimited(t *testing.T) {
+	p, sleeps := newTestPacer(0, 0, 0, 0)
+
+	calls := 0
+	err := p.retryRateLimited(func() error {
+		calls++
+		switch calls {
+		case 1:
+			return &bitrise.RateLimitError{RetryAfter: 10 * time.Second, HasRetryAfter: true}
+		case 2:
+			return &bitrise.RateLimitError{}
+		case 3:
+			// Retry-After: 0 means retry now
+			return &bitrise.RateLimitError{HasRetryAfter: true}
+		case 4:
+			return &bitrise.RateLimitError{RetryAfter: 24 * time.Hour, HasRetryAfter: true}
+		default:
+			return nil
+		}
+	})
+	require.NoError(t, err)
+	require.Equal(t, 5, calls)
+	require.Equal(t, []time.Duration{10 * time.Second, defaultRateLimitWait, maxRateLimitWait}, *sleeps)
+
+	calls = 0
+	otherErr := errors.New("bad request")
+	require.Equal(t, otherErr, p.retryRateLimited(func() error {
+		calls++
+		return otherErr
+	}))
+	require.Equal(t, 1, calls)
+
+	calls = 0
+	err = p.retryRateLimited(func() error {
+		calls++
+		return &bitrise.RateLimitError{RetryAfter: time.Second}
+	})
+	require.Error(t, err)
+	require.Equal(t, maxRateLimitedStarts+1, calls)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/bitrise-io/go-utils/log"
+	"github.com/bitrise-steplib/bitrise-step-build-router-start/bitrise"
+)
+
+// progressReporter prints a consolidated snapshot of the builds waited for, at most once per interval.
+// Bitrise logs are not terminals, so the snapshot is printed as plain lines instead of being redrawn.
+type progressReporter struct {
+	interval   time.Duration
+	historical map[string]durationStats
+	startedAt  time.Time
+	lastReport time.Time
+}
+
+func newProgressReporter(interval time.Duration, historical map[string]durationStats, now time.Time) *progressReporter {
+	return &progressReporter{
+		interval:   interval,
+		historical: historical,
+		startedAt:  now,
+		lastReport: now,
+	}
+}
+
+func (p *progressReporter) report(results []bitrise.BuildResult, now time.Time) {
+	if now.Sub(p.lastReport) < p.interval {
+		return
+	}
+	p.lastReport = now
+
+	fmt.Println()
+	for _, line := range renderProgress(results, p.historical, now.Sub(p.startedAt), now) {
+		log.Printf("%s", line)
+	}
+	fmt.Println()
+}
+
+func formatDuration(d time.Duration) string {
+	return d.Round(time.Second).String()
+}
+
+// renderProgress returns the lines of a progress snapshot: the summary line with the counts and the ETA,
+// and a line per build with its elapsed time and, if known, its usual duration.
+func renderProgress(results []bitrise.BuildResult, historical map[string]durationStats, waited time.Duration, now time.Time) []string {
+	var running, succeeded, failed int
+	var eta time.Duration
+	etaKnown := true
+
+	workflowWidth := 0
+	for _, result := range results {
+		if len(result.Workflow) > workflowWidth {
+			workflowWidth = len(result.Workflow)
+		}
+	}
+
+	var buildLines []string
+	for _, result := range results {
+		var state, elapsed string
+		stats, hasStats := historical[result.Workflow]
+
+		switch {
+		case result.Status.IsSuccess():
+			succeeded++
+			state, elapsed = result.Status.String(), formatDuration(result.Duration())
+		case result.Status.IsFailure():
+			failed++
+			state, elapsed = result.Status.String(), formatDuration(result.Duration())
+		case result.StartedAt.IsZero():
+			running++
+			state = "queued"
+			if !result.TriggeredAt.IsZero() {
+				elapsed = formatDuration(now.Sub(result.TriggeredAt))
+			}
+			if hasStats {
+				// The build still has to run for its usual duration after it gets a worker.
+				eta = maxDuration(eta, stats.Median)
+			} else {
+				etaKnown = false
+			}
+		default:
+			running++
+			state = "running"
+			took := now.Sub(result.StartedAt)
+			elapsed = formatDuration(took)
+			if hasStats {
+				eta = maxDuration(eta, stats.Median-took)
+			} else {
+				etaKnown = false
+			}
+		}
+
+		line := fmt.Sprintf("- %-*s %-20s %s", workflowWidth, result.Workflow, state, elapsed)
+		if hasStats {
+			line += fmt.Sprintf(" (usually %s)", formatDuration(stats.Median))
+		}
+		buildLines = append(buildLines, strings.TrimRight(line, " "))
+	}
+
+	summary := fmt.Sprintf("Progress after %s: %d running, %d succeeded, %d failed", formatDuration(waited), running, succeeded, failed)
+	if running > 0 && etaKnown {
+		summary += fmt.Sprintf(", ETA %s", formatDuration(eta))
+	}
+	return append([]string{summary}, buildLines...)
+}
+
+func maxDuration(a, b time.Duration) time.Duration {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bitrise-steplib/bitrise-step-build-router-start/bitrise"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_renderProgress(t *testing.T) {
+	now := time.Date(2020, 1, 1, 10, 10, 0, 0, time.UTC)
+	results := []bitrise.BuildResult{
+		{Workflow: "ui-test", Status: bitrise.BuildStatusRunning, TriggeredAt: now.Add(-5 * time.Minute), StartedAt: now.Add(-4 * time.Minute)},
+		{Workflow: "unit", Status: bitrise.BuildStatusSuccessful, StartedAt: now.Add(-3 * time.Minute), FinishedAt: now.Add(-time.Minute)},
+		{Workflow: "lint", Status: bitrise.BuildStatusFailed, StartedAt: now.Add(-3 * time.Minute), FinishedAt: now.Add(-2 * time.Minute)},
+		{Workflow: "deploy", Status: bitrise.BuildStatusRunning, TriggeredAt: now.Add(-time.Minute)},
+	}
+	historical := map[string]durationStats{
+		"ui-test": {Median: 10 * time.Minute, Samples: 5},
+		"deploy":  {Median: 3 * time.Minute, Samples: 5},
+	}
+
+	lines := renderProgress(results, historical, 5*time.Minute, now)
+	require.Equal(t, []string{
+		"Progress after 5m0s: 2 running, 1 succeeded, 1 failed, ETA 6m0s",
+		"- ui-test running              4m0s (usually 10m0s)",
+		"- unit    success              2m0s",
+		"- lint    error                1m0s",
+		"- deploy  queued               1m0s (usually 3m0s)",
+	}, lines)
+
+	delete(historical, "deploy")
+	lines = renderProgress(results, historical, 5*time.Minute, now)
+	require.Equal(t, "Progress after 5m0s: 2 running, 1 succeeded, 1 failed", lines[0])
+}
+
+func Test_percentile(t *testing.T) {
+	durations := []time.Duration{5, 1, 4, 2, 3, 10, 9, 8, 7, 6}
+	require.Equal(t, time.Duration(5), percentile(durations, 50))
+	require.Equal(t, time.Duration(9), percentile(durations, 90))
+	require.Equal(t, time.Duration(1), percentile(durations, 0))
+	require.Equal(t, time.Duration(0), percentile(nil, 50))
+}
+
+func Test_newDurationStats(t *testing.T) {
+	start := time.Date(2020, 1, 1, 10, 0, 0, 0, time.UTC)
+	finish1, finish2 := start.Add(time.Minute), start.Add(3*time.Minute)
+	stats, ok := newDurationStats([]bitrise.Build{
+		{StartedOnWorkerAt: &start, FinishedAt: &finish1},
+		{StartedOnWorkerAt: &start, FinishedAt: &finish2},
+		{StartedOnWorkerAt: &start},
+	})
+	require.True(t, ok)
+	require.Equal(t, durationStats{Median: time.Minute, P90: 3 * time.Minute, Samples: 2}, stats)
+
+	_, ok = newDurationStats(nil)
+	require.False(t, ok)
+}
+
+func Test_router_historicalDurations(t *testing.T) {
+	var listed []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		listed = append(listed, r.URL.Query().Get("workflow"))
+		fmt.Fprint(w, `{"data": [{"slug": "b1", "status": 1, "started_on_worker_at": "2022-01-01T10:00:00Z", "finished_at": "2022-01-01T10:05:00Z"}]}`)
+	}))
+	defer server.Close()
+
+	r := router{
+		app:   bitrise.App{BaseURL: server.URL, Slug: "app", AccessToken: "token", IsDebugRetryTimings: true},
+		state: newRouterState("", "parent", []string{"ui-test", "lint", "ui-test"}),
+	}
+
+	first := r.historicalDurations()
+	require.Equal(t, 5*time.Minute, first["ui-test"].Median)
+	require.Equal(t, first, r.historicalDurations())
+	require.Equal(t, []string{"ui-test", "lint"}, listed, "the recent builds are listed once per run")
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/bitrise-io/go-utils/log"
+	"github.com/bitrise-steplib/bitrise-step-build-router-start/bitrise"
+)
+
+// reusableBuildsLimit is the number of recent successful builds of a workflow checked for the same commit.
+const reusableBuildsLimit = 20
+
+// buildCommitHash returns the commit the build ran on, read from the build params if the API doesn't report it.
+func buildCommitHash(build bitrise.Build) string {
+	if build.CommitHash != "" {
+		return build.CommitHash
+	}
+
+	var params struct {
+		CommitHash string `json:"commit_hash"`
+	}
+	if err := json.Unmarshal(build.OriginalBuildParams, &params); err != nil {
+		log.Debugf("Failed to parse build params: %s", err)
+	}
+	return params.CommitHash
+}
+
+// buildReuser finds the successful builds of the workflows which ran on the same commit as the parent build.
+type buildReuser struct {
+	app        bitrise.App
+	commitHash string
+	// maxAge is how long ago a build may have finished to be reused, 0 means no limit.
+	maxAge time.Duration
+	now    func() time.Time
+	// used holds the reused build slugs, so a workflow listed multiple times doesn't reuse the same build.
+	used map[string]bool
+}
+
+func newBuildReuser(app bitrise.App, parent bitrise.Build, maxAge time.Duration) *buildReuser {
+	return &buildReuser{
+		app:        app,
+		commitHash: buildCommitHash(parent),
+		maxAge:     maxAge,
+		now:        time.Now,
+		used:       map[string]bool{},
+	}
+}
+
+// find returns the most recent reusable build of the workflow, nil if there is none.
+func (r *buildReuser) find(workflow string) (*bitrise.Build, error) {
+	if r.commitHash == "" {
+		return nil, nil
+	}
+
+	successStatus := bitrise.BuildStatusSuccessful
+	response, err := r.app.ListBuilds(bitrise.ListBuildsParams{Workflow: workflow, Status: &successStatus, Limit: reusableBuildsLimit})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list successful builds of %s: %s", workflow, err)
+	}
+
+	for _, build := range response.Builds {
+		if build.TriggeredWorkflow != workflow || !build.IsSuccessful() || r.used[build.Slug] {
+			continue
+		}
+		if buildCommitHash(build) != r.commitHash {
+			continue
+		}
+		if r.maxAge > 0 && (build.FinishedAt == nil || r.now().Sub(*build.FinishedAt) > r.maxAge) {
+			continue
+		}
+
+		r.used[build.Slug] = true
+		return &build, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bitrise-steplib/bitrise-step-build-router-start/bitrise"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_buildCommitHash(t *testing.T) {
+	require.Equal(t, "abc", buildCommitHash(bitrise.Build{CommitHash: "abc", OriginalBuildParams: json.RawMessage(`{"commit_hash": "def"}`)}))
+	require.Equal(t, "def", buildCommitHash(bitrise.Build{OriginalBuildParams: json.RawMessage(`{"commit_hash": "def"}`)}))
+	require.Equal(t, "", buildCommitHash(bitrise.Build{}))
+}
+
+func reuseTestServer(t *testing.T, started *[]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPost:
+			*started = append(*started, r.URL.Path)
+			fmt.Fprint(w, `{"status": "ok", "build_slug": "started", "build_number": 30, "triggered_workflow": "lint"}`)
+		case r.URL.Path == "/v0.1/apps/app/builds":
+			require.Equal(t, "1", r.URL.Query().Get("status"))
+			if r.URL.Query().Get("workflow") != "ui-test" {
+				fmt.Fprint(w, `{"data": []}`)
+				return
+			}
+			fmt.Fprint(w, `{"data": [
+				{"slug": "other-commit", "status": 1, "build_number": 23, "triggered_workflow": "ui-test", "commit_hash": "def", "finished_at": "2022-01-01T11:00:00Z"},
+				{"slug": "recent", "status": 1, "build_number": 22, "triggered_workflow": "ui-test", "commit_hash": "abc", "finished_at": "2022-01-01T10:00:00Z"},
+				{"slug": "old", "status": 1, "build_number": 21, "triggered_workflow": "ui-test", "commit_hash": "abc", "finished_at": "2021-12-01T10:00:00Z"}
+			]}`)
+		default:
+			t.Errorf("unexpected request: %s", r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+func Test_buildReuser_find(t *testing.T) {
+	server := reuseTestServer(t, nil)
+	defer server.Close()
+
+	app := bitrise.App{BaseURL: server.URL, Slug: "app", AccessToken: "token", IsDebugRetryTimings: true}
+	reuser := newBuildReuser(app, bitrise.Build{CommitHash: "abc"}, 24*time.Hour)
+	reuser.now = func() time.Time { return time.Date(2022, 1, 1, 12, 0, 0, 0, time.UTC) }
+
+	build, err := reuser.find("ui-test")
+	require.NoError(t, err)
+	require.NotNil(t, build)
+	require.Equal(t, "recent", build.Slug)
+
+	// the old build is outside of the max age and the recent one is already reused
+	build, err = reuser.find("ui-test")
+	require.NoError(t, err)
+	require.Nil(t, build)
+
+	reuser.maxAge = 0
+	build, err = reuser.find("ui-test")
+	require.NoError(t, err)
+	require.NotNil(t, build)
+	require.Equal(t, "old", build.Slug)
+}
+
+func Test_startStage_reusesBuilds(t *testing.T) {
+	stubEnvman(t)
+
+	var started []string
+	server := reuseTestServer(t, &started)
+	defer server.Close()
+
+	app := bitrise.App{BaseURL: server.URL, Slug: "app", AccessToken: "token", IsDebugRetryTimings: true}
+	sink := &recordingSink{}
+	r := router{
+		app:               app,
+		events:            &eventBus{},
+		state:             newRouterState("", "parent", []string{"ui-test", "lint"}),
+		parentBuildParams: json.RawMessage(`{"branch": "main", "commit_hash": "abc"}`),
+		workflowEnvs:      map[string][]bitrise.Environment{},
+		reuser:            newBuildReuser(app, bitrise.Build{CommitHash: "abc"}, 0),
+	}
+	r.events.subscribe(sink)
+
+	buildSlugs, err := r.startStage(0, 0, []string{"ui-test", "lint"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"recent", "started"}, buildSlugs)
+	require.Len(t, started, 1)
+
+	reused := r.state.Builds[0]
+	require.True(t, reused.Reused)
+	require.Equal(t, bitrise.BuildStatusSuccessful, reused.Status)
+	require.Equal(t, int64(22), reused.BuildNumber)
+	require.False(t, r.state.Builds[1].Reused)
+
+	require.Len(t, sink.events, 2)
+	require.Equal(t, eventReused, sink.events[0].Type)
+	require.Equal(t, eventStarted, sink.events[1].Type)
+}
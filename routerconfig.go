@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// routerConfigVersion is the only supported version of the router config schema (router.schema.json).
+const routerConfigVersion = 1
+
+// routerConfig is the router config file, an alternative to the workflows, stages, environment_key_list, workflow_conditions,
+// changed_files_rules, wait_for_builds and abort_on_fail inputs, with per-workflow settings.
+type routerConfig struct {
+	Version   int               `yaml:"version"`
+	Envs      []string          `yaml:"envs"`
+	Wait      *waitPolicyConfig `yaml:"wait"`
+	Workflows []workflowConfig  `yaml:"workflows"`
+}
+
+type waitPolicyConfig struct {
+	Enabled     *bool `yaml:"enabled"`
+	AbortOnFail *bool `yaml:"abort_on_fail"`
+	// AbortScope selects the builds aborted on failure, see the abort_scope input.
+	AbortScope string `yaml:"abort_scope"`
+	// PollInterval is the number of seconds between two status checks of the builds.
+	PollInterval int `yaml:"poll_interval"`
+}
+
+type workflowConfig struct {
+	Name string `yaml:"name"`
+	// Stage groups the workflows, the stages are started one after the other in the order of their first workflow.
+	Stage        string   `yaml:"stage"`
+	Envs         []string `yaml:"envs"`
+	Condition    string   `yaml:"condition"`
+	ChangedFiles []string `yaml:"changed_files"`
+	Retries      int      `yaml:"retries"`
+	AllowFailure bool     `yaml:"allow_failure"`
+	Artifacts    []string `yaml:"artifacts"`
+}
+
+// workflowPolicy holds the per-workflow settings which have no input counterpart.
+type workflowPolicy struct {
+	// Retries is the number of times a failed build of the workflow is restarted.
+	Retries int
+	// AllowFailure builds don't fail the Step and don't trigger abort on fail.
+	AllowFailure bool
+	// Artifacts are the globs of the artifact titles to download, every artifact is downloaded if empty.
+	Artifacts []string
+}
+
+func (p workflowPolicy) downloadsArtifact(title string) bool {
+	if len(p.Artifacts) == 0 {
+		return true
+	}
+	for _, glob := range p.Artifacts {
+		if matched, err := path.Match(glob, title); err == nil && matched {
+			return true
+		}
+	}
+	return false
+}
+
+// loadRouterConfig reads the router config from the given file or inline YAML, it returns nil if neither is given.
+func loadRouterConfig(pth, inline string) (*routerConfig, error) {
+	pth, inline = strings.TrimSpace(pth), strings.TrimSpace(inline)
+	switch {
+	case pth != "" && inline != "":
+		return nil, fmt.Errorf("either the router config path or the inline router config can be given, not both")
+	case pth != "":
+		content, err := ioutil.ReadFile(pth)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read router config: %s", err)
+		}
+		c, err := parseRouterConfig(content)
+		if err != nil {
+			return nil, fmt.Errorf("invalid router config (%s): %s", pth, err)
+		}
+		return &c, nil
+	case inline != "":
+		c, err := parseRouterConfig([]byte(inline))
+		if err != nil {
+			return nil, fmt.Errorf("invalid router config: %s", err)
+		}
+		return &c, nil
+	}
+	return nil, nil
+}
+
+// parseRouterConfig decodes the config, failing on unknown fields, and validates it.
+// The errors refer to the line of the invalid value.
+func parseRouterConfig(content []byte) (routerConfig, error) {
+	var root yaml.Node
+	if err := yaml.Unmarshal(content, &root); err != nil {
+		return routerConfig{}, err
+	}
+	if len(root.Content) == 0 {
+		return routerConfig{}, fmt.Errorf("empty config")
+	}
+
+	var c routerConfig
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&c); err != nil {
+		return routerConfig{}, err
+	}
+
+	if errs := c.validate(&root); len(errs) > 0 {
+		return routerConfig{}, fmt.Errorf("%s", strings.Join(errs, "\n"))
+	}
+	return c, nil
+}
+
+// nodeLine returns the line of the value at the given path of map keys (string) and sequence indexes (int),
+// or the line of the deepest existing parent.
+func nodeLine(root *yaml.Node, keys ...interface{}) int {
+	node := root
+	if node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+
+	for _, key := range keys {
+		var next *yaml.Node
+		switch k := key.(type) {
+		case string:
+			if node.Kind == yaml.MappingNode {
+				for i := 0; i+1 < len(node.Content); i += 2 {
+					if node.Content[i].Value == k {
+						next = node.Content[i+1]
+						break
+					}
+				}
+			}
+		case int:
+			if node.Kind == yaml.SequenceNode && k < len(node.Content) {
+				next = node.Content[k]
+			}
+		}
+		if next == nil {
+			break
+		}
+		node = next
+	}
+	return node.Line
+}
+
+// configError is a validation error of the router config.
+type configError struct {
+	line int
+	msg  string
+}
+
+// validate returns the validation errors, ordered by line.
+func (c routerConfig) validate(root *yaml.Node) []string {
+	var configErrs []configError
+	addErr := func(line int, format string, args ...interface{}) {
+		configErrs = append(configErrs, configError{line: line, msg: fmt.Sprintf(format, args...)})
+	}
+
+	switch c.Version {
+	case 0:
+		addErr(nodeLine(root), "version is required")
+	case routerConfigVersion:
+	default:
+		addErr(nodeLine(root, "version"), "unsupported version %d, the supported version is %d", c.Version, routerConfigVersion)
+	}
+
+	for i, line := range c.Envs {
+		if _, err := parseEnvPattern(strings.TrimSpace(line)); err != nil {
+			addErr(nodeLine(root, "envs", i), "invalid env: %s", err)
+		}
+	}
+
+	if c.Wait != nil && c.Wait.PollInterval < 0 {
+		addErr(nodeLine(root, "wait", "poll_interval"), "poll_interval can't be negative")
+	}
+	if c.Wait != nil && c.Wait.AbortScope != "" && !contains(abortScopes, c.Wait.AbortScope) {
+		addErr(nodeLine(root, "wait", "abort_scope"), "abort_scope must be one of %s", strings.Join(abortScopes, ", "))
+	}
+
+	if len(c.Workflows) == 0 {
+		addErr(nodeLine(root, "workflows"), "at least one workflow is required")
+	}
+
+	staged := 0
+	for _, wf := range c.Workflows {
+		if strings.TrimSpace(wf.Stage) != "" {
+			staged++
+		}
+	}
+
+	names := map[string]bool{}
+	for i, wf := range c.Workflows {
+		line := func(keys ...interface{}) int {
+			return nodeLine(root, append([]interface{}{"workflows", i}, keys...)...)
+		}
+
+		name := strings.TrimSpace(wf.Name)
+		switch {
+		case name == "":
+			addErr(line(), "workflow name is required")
+		case strings.ContainsAny(name, ",[]:"):
+			addErr(line("name"), "invalid workflow name (%s)", name)
+		case names[name]:
+			addErr(line("name"), "duplicate workflow (%s)", name)
+		}
+		names[name] = true
+
+		if staged > 0 && strings.TrimSpace(wf.Stage) == "" {
+			addErr(line(), "stage is required if any of the workflows has a stage (%s)", name)
+		}
+
+		for j, env := range wf.Envs {
+			env = strings.TrimSpace(env)
+			if strings.HasPrefix(env, "[") {
+				addErr(line("envs", j), "workflow list prefix is not allowed in the envs of a workflow (%s)", env)
+				continue
+			}
+			if _, err := parseEnvPattern(env); err != nil {
+				addErr(line("envs", j), "invalid env: %s", err)
+			}
+		}
+
+		if strings.TrimSpace(wf.Condition) != "" {
+			if _, err := parseCondition(wf.Condition); err != nil {
+				addErr(line("condition"), "invalid condition: %s", err)
+			}
+		}
+
+		for j, glob := range wf.ChangedFiles {
+			if _, err := parsePathRules(glob + " -> " + name); err != nil || strings.Contains(glob, ",") {
+				addErr(line("changed_files", j), "invalid changed files glob (%s)", glob)
+			}
+		}
+
+		if wf.Retries < 0 {
+			addErr(line("retries"), "retries can't be negative")
+		}
+
+		for j, glob := range wf.Artifacts {
+			if _, err := path.Match(glob, ""); err != nil {
+				addErr(line("artifacts", j), "invalid artifact glob (%s): %s", glob, err)
+			}
+		}
+	}
+	sort.SliceStable(configErrs, func(i, j int) bool {
+		return configErrs[i].line < configErrs[j].line
+	})
+
+	var errs []string
+	for _, e := range configErrs {
+		errs = append(errs, fmt.Sprintf("line %d: %s", e.line, e.msg))
+	}
+	return errs
+}
+
+// apply overrides the inputs covered by the config and returns the per-workflow policies.
+func (c routerConfig) apply(cfg *Config) map[string]workflowPolicy {
+	var workflows, envs, conditions, rules, stageNames []string
+	envs = append(envs, c.Envs...)
+	stages := map[string][]string{}
+
+	policies := map[string]workflowPolicy{}
+	for _, wf := range c.Workflows {
+		name := strings.TrimSpace(wf.Name)
+		workflows = append(workflows, name)
+
+		if stage := strings.TrimSpace(wf.Stage); stage != "" {
+			if _, ok := stages[stage]; !ok {
+				stageNames = append(stageNames, stage)
+			}
+			stages[stage] = append(stages[stage], name)
+		}
+
+		for _, env := range wf.Envs {
+			envs = append(envs, fmt.Sprintf("[%s] %s", name, strings.TrimSpace(env)))
+		}
+		if condition := strings.TrimSpace(wf.Condition); condition != "" {
+			conditions = append(conditions, name+": "+condition)
+		}
+		for _, glob := range wf.ChangedFiles {
+			rules = append(rules, strings.TrimSpace(glob)+" -> "+name)
+		}
+
+		policies[name] = workflowPolicy{
+			Retries:      wf.Retries,
+			AllowFailure: wf.AllowFailure,
+			Artifacts:    wf.Artifacts,
+		}
+	}
+
+	cfg.Workflows = strings.Join(workflows, "\n")
+	cfg.Stages = ""
+	for _, stage := range stageNames {
+		cfg.Stages += strings.Join(stages[stage], ", ") + "\n"
+	}
+	cfg.Environments = strings.Join(envs, "\n")
+	cfg.WorkflowConditions = strings.Join(conditions, "\n")
+	cfg.ChangedFilesRules = strings.Join(rules, "\n")
+
+	if c.Wait != nil {
+		if c.Wait.Enabled != nil {
+			cfg.WaitForBuilds = fmt.Sprint(*c.Wait.Enabled)
+		}
+		if c.Wait.AbortOnFail != nil {
+			cfg.AbortBuildsOnFail = "no"
+			if *c.Wait.AbortOnFail {
+				cfg.AbortBuildsOnFail = "yes"
+			}
+		}
+		if c.Wait.AbortScope != "" {
+			cfg.AbortScope = c.Wait.AbortScope
+		}
+	}
+	return policies
+}
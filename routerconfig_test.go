@@ -0,0 +1,169 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const testRouterConfig = `version: 1
+envs:
+- APP_*
+wait:
+  enabled: true
+  abort_on_fail: false
+  abort_scope: stage
+  poll_interval: 10
+workflows:
+- name: test-ios
+  envs:
+  - TEST_PLAN:=ios
+  condition: '!is_tag'
+  changed_files:
+  - ios/**
+  - shared/**
+  retries: 2
+  artifacts:
+  - "*.zip"
+- name: lint
+  allow_failure: true
+`
+
+func Test_parseRouterConfig(t *testing.T) {
+	c, err := parseRouterConfig([]byte(testRouterConfig))
+	require.NoError(t, err)
+
+	cfg := Config{Workflows: "ignored", Environments: "ignored", WaitForBuilds: "false", AbortBuildsOnFail: "yes"}
+	policies := c.apply(&cfg)
+
+	require.Equal(t, "test-ios\nlint", cfg.Workflows)
+	require.Equal(t, "APP_*\n[test-ios] TEST_PLAN:=ios", cfg.Environments)
+	require.Equal(t, "test-ios: !is_tag", cfg.WorkflowConditions)
+	require.Equal(t, "ios/** -> test-ios\nshared/** -> test-ios", cfg.ChangedFilesRules)
+	require.Equal(t, "true", cfg.WaitForBuilds)
+	require.Equal(t, "no", cfg.AbortBuildsOnFail)
+	require.Equal(t, "stage", cfg.AbortScope)
+	require.Equal(t, 10, c.Wait.PollInterval)
+	require.Equal(t, map[string]workflowPolicy{
+		"test-ios": {Retries: 2, Artifacts: []string{"*.zip"}},
+		"lint":     {AllowFailure: true},
+	}, policies)
+
+	require.True(t, policies["test-ios"].downloadsArtifact("app.zip"))
+	require.False(t, policies["test-ios"].downloadsArtifact("app.ipa"))
+	require.True(t, policies["lint"].downloadsArtifact("app.ipa"))
+}
+
+func Test_routerConfig_replacesInputs(t *testing.T) {
+	c, err := parseRouterConfig([]byte("version: 1\nworkflows:\n- name: lint\n"))
+	require.NoError(t, err)
+
+	cfg := Config{
+		Workflows:          "test",
+		Stages:             "test",
+		Environments:       "APP_*",
+		WorkflowConditions: "test: is_pr",
+		ChangedFilesRules:  "ios/** -> test",
+	}
+	c.apply(&cfg)
+
+	require.Equal(t, "lint", cfg.Workflows)
+	require.Empty(t, cfg.Stages)
+	require.Empty(t, cfg.Environments)
+	require.Empty(t, cfg.WorkflowConditions)
+	require.Empty(t, cfg.ChangedFilesRules)
+}
+
+func Test_parseRouterConfig_errors(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		wantErr string
+	}{
+		{
+			name:    "empty",
+			config:  "",
+			wantErr: "empty config",
+		},
+		{
+			name:    "syntax error",
+			config:  "version: 1\nworkflows: [\n",
+			wantErr: "yaml: line 2: did not find expected node content",
+		},
+		{
+			name:    "unknown field",
+			config:  "version: 1\nworkflows:\n- name: wf\n  retry: 2\n",
+			wantErr: "yaml: unmarshal errors:\n  line 4: field retry not found in type main.workflowConfig",
+		},
+		{
+			name:    "wrong type",
+			config:  "version: 1\nworkflows:\n- name: wf\n  retries: many\n",
+			wantErr: "yaml: unmarshal errors:\n  line 4: cannot unmarshal !!str `many` into int",
+		},
+		{
+			name:    "version",
+			config:  "version: 2\nworkflows:\n- name: wf\n",
+			wantErr: "line 1: unsupported version 2, the supported version is 1",
+		},
+		{
+			name:   "semantic errors",
+			config: "version: 1\nworkflows:\n- name: wf\n  condition: is_pr &&\n- name: wf\n  retries: -1\n  envs:\n  - '[other] KEY'\n- envs:\n  - /[/\n",
+			wantErr: "line 4: invalid condition: unexpected end of expression at position 9\n" +
+				"line 5: duplicate workflow (wf)\n" +
+				"line 6: retries can't be negative\n" +
+				"line 8: workflow list prefix is not allowed in the envs of a workflow ([other] KEY)\n" +
+				"line 9: workflow name is required\n" +
+				"line 10: invalid env: invalid regular expression (/[/): error parsing regexp: missing closing ]: `[`",
+		},
+		{
+			name:    "abort scope",
+			config:  "version: 1\nwait:\n  abort_scope: some\nworkflows:\n- name: wf\n",
+			wantErr: "line 3: abort_scope must be one of all, stage, none",
+		},
+		{
+			name:    "no workflows",
+			config:  "version: 1\n",
+			wantErr: "line 1: at least one workflow is required",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseRouterConfig([]byte(tt.config))
+			require.EqualError(t, err, tt.wantErr)
+		})
+	}
+}
+
+func Test_loadRouterConfig(t *testing.T) {
+	c, err := loadRouterConfig("", "")
+	require.NoError(t, err)
+	require.Nil(t, c)
+
+	pth := filepath.Join(t.TempDir(), "router.yml")
+	require.NoError(t, ioutil.WriteFile(pth, []byte(testRouterConfig), 0644))
+
+	c, err = loadRouterConfig(pth, "")
+	require.NoError(t, err)
+	require.Len(t, c.Workflows, 2)
+
+	c, err = loadRouterConfig("", testRouterConfig)
+	require.NoError(t, err)
+	require.Len(t, c.Workflows, 2)
+
+	_, err = loadRouterConfig(pth, testRouterConfig)
+	require.Error(t, err)
+}
+
+func Test_routerConfig_stages(t *testing.T) {
+	c, err := parseRouterConfig([]byte("version: 1\nworkflows:\n- name: lint\n  stage: check\n- name: ui\n  stage: test\n- name: unit\n  stage: check\n"))
+	require.NoError(t, err)
+
+	var cfg Config
+	c.apply(&cfg)
+	require.Equal(t, [][]string{{"lint", "unit"}, {"ui"}}, parseStages(cfg.Stages, cfg.Workflows))
+
+	_, err = parseRouterConfig([]byte("version: 1\nworkflows:\n- name: lint\n  stage: check\n- name: ui\n"))
+	require.EqualError(t, err, "line 5: stage is required if any of the workflows has a stage (ui)")
+}
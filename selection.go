@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/bitrise-io/go-utils/log"
+	"github.com/bitrise-steplib/bitrise-step-build-router-start/bitrise"
+)
+
+// workflowSelection tells if a workflow is started and why.
+type workflowSelection struct {
+	Workflow string
+	Included bool
+	Reason   string
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// selectWorkflows filters the workflows by the workflow conditions, then by the changed files rules,
+// and returns the workflows to start and the skipped ones with the reason.
+func (r *router) selectWorkflows(workflows []string, build bitrise.Build) ([]string, []skippedWorkflow, error) {
+	conditions, err := parseWorkflowConditions(r.cfg.WorkflowConditions)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid workflow conditions: %s", err)
+	}
+	if len(conditions) == 0 && len(splitLines(r.cfg.ChangedFilesRules)) == 0 {
+		return workflows, nil, nil
+	}
+
+	var skipped []skippedWorkflow
+	apply := func(selections []workflowSelection) []string {
+		var selected []string
+		for _, selection := range selections {
+			if selection.Included {
+				log.Printf("- starting %s: %s", selection.Workflow, selection.Reason)
+				selected = append(selected, selection.Workflow)
+			} else {
+				log.Printf("- skipping %s: %s", selection.Workflow, selection.Reason)
+				skipped = append(skipped, skippedWorkflow{Workflow: selection.Workflow, Reason: selection.Reason})
+			}
+		}
+		return selected
+	}
+
+	log.Infof("Selecting workflows:")
+
+	if len(conditions) > 0 {
+		for _, wc := range conditions {
+			if !contains(workflows, wc.workflow) {
+				log.Warnf("Condition %s refers to %s, which is not in the workflows input", wc.expression, wc.workflow)
+			}
+		}
+
+		selections, err := selectWorkflowsByConditions(workflows, conditions, newConditionContext(build))
+		if err != nil {
+			return nil, nil, err
+		}
+		workflows = apply(selections)
+	}
+
+	selections, err := r.changedFilesSelections(workflows, build.OriginalBuildParams)
+	if err != nil {
+		return nil, nil, err
+	}
+	if selections != nil {
+		workflows = apply(selections)
+	}
+
+	fmt.Println()
+	return workflows, skipped, nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/bitrise-steplib/bitrise-step-build-router-start/bitrise"
+)
+
+const (
+	hungBuildActionAbort = "abort"
+	hungBuildActionFail  = "fail"
+
+	// minSlowBuildSamples is the number of recent successful builds required to judge a build slow.
+	minSlowBuildSamples = 5
+)
+
+// slowBuildDetector flags the running builds taking longer than a multiple of the p90 duration of their workflow.
+// Builds exceeding slowFactor * p90 are slow, builds exceeding hungFactor * p90 are hung, a factor of 0 disables the check.
+type slowBuildDetector struct {
+	historical map[string]durationStats
+	slowFactor float64
+	hungFactor float64
+
+	slow map[string]bool
+	hung map[string]bool
+}
+
+func newSlowBuildDetector(historical map[string]durationStats, slowFactor, hungFactor float64) *slowBuildDetector {
+	return &slowBuildDetector{
+		historical: historical,
+		slowFactor: slowFactor,
+		hungFactor: hungFactor,
+		slow:       map[string]bool{},
+		hung:       map[string]bool{},
+	}
+}
+
+func (d *slowBuildDetector) enabled() bool {
+	return d.slowFactor > 0 || d.hungFactor > 0
+}
+
+// slowBuild is a running build reported by the detector.
+type slowBuild struct {
+	Slug     string
+	Workflow string
+	Running  time.Duration
+	Limit    time.Duration
+	P90      time.Duration
+}
+
+func (b slowBuild) String() string {
+	return fmt.Sprintf("%s is running for %s, longer than %s (%s is the p90 duration of its recent successful builds)",
+		b.Workflow, formatDuration(b.Running), formatDuration(b.Limit), formatDuration(b.P90))
+}
+
+func factorOf(d time.Duration, factor float64) time.Duration {
+	return time.Duration(float64(d) * factor)
+}
+
+// check returns the builds which became slow or hung since the previous check, every build is reported once for each.
+func (d *slowBuildDetector) check(results []bitrise.BuildResult, now time.Time) (slow, hung []slowBuild) {
+	for _, result := range results {
+		if result.Status.IsTerminal() || result.StartedAt.IsZero() {
+			continue
+		}
+		stats, ok := d.historical[result.Workflow]
+		if !ok || stats.Samples < minSlowBuildSamples || stats.P90 == 0 {
+			continue
+		}
+
+		running := now.Sub(result.StartedAt)
+		build := slowBuild{Slug: result.Slug, Workflow: result.Workflow, Running: running, P90: stats.P90}
+
+		if d.hungFactor > 0 && !d.hung[result.Slug] && running > factorOf(stats.P90, d.hungFactor) {
+			d.hung[result.Slug] = true
+			d.slow[result.Slug] = true
+			build.Limit = factorOf(stats.P90, d.hungFactor)
+			hung = append(hung, build)
+			continue
+		}
+		if d.slowFactor > 0 && !d.slow[result.Slug] && running > factorOf(stats.P90, d.slowFactor) {
+			d.slow[result.Slug] = true
+			build.Limit = factorOf(stats.P90, d.slowFactor)
+			slow = append(slow, build)
+		}
+	}
+	return slow, hung
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bitrise-steplib/bitrise-step-build-router-start/bitrise"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_slowBuildDetector_check(t *testing.T) {
+	now := time.Date(2020, 1, 1, 10, 0, 0, 0, time.UTC)
+	historical := map[string]durationStats{
+		"ui-test": {Median: 8 * time.Minute, P90: 10 * time.Minute, Samples: 10},
+		"unit":    {Median: 8 * time.Minute, P90: 10 * time.Minute, Samples: 2},
+	}
+	running := func(workflow string, d time.Duration) bitrise.BuildResult {
+		return bitrise.BuildResult{Slug: workflow + "-slug", Workflow: workflow, Status: bitrise.BuildStatusRunning, StartedAt: now.Add(-d)}
+	}
+
+	d := newSlowBuildDetector(historical, 1.5, 3)
+
+	slow, hung := d.check([]bitrise.BuildResult{running("ui-test", 14*time.Minute), running("unit", time.Hour)}, now)
+	require.Empty(t, slow)
+	require.Empty(t, hung)
+
+	slow, hung = d.check([]bitrise.BuildResult{running("ui-test", 16*time.Minute)}, now)
+	require.Equal(t, []slowBuild{{Slug: "ui-test-slug", Workflow: "ui-test", Running: 16 * time.Minute, Limit: 15 * time.Minute, P90: 10 * time.Minute}}, slow)
+	require.Empty(t, hung)
+	require.Equal(t, "ui-test is running for 16m0s, longer than 15m0s (10m0s is the p90 duration of its recent successful builds)", slow[0].String())
+
+	slow, hung = d.check([]bitrise.BuildResult{running("ui-test", 20*time.Minute)}, now)
+	require.Empty(t, slow)
+	require.Empty(t, hung)
+
+	slow, hung = d.check([]bitrise.BuildResult{running("ui-test", 31*time.Minute)}, now)
+	require.Empty(t, slow)
+	require.Len(t, hung, 1)
+	require.Equal(t, 30*time.Minute, hung[0].Limit)
+
+	slow, hung = d.check([]bitrise.BuildResult{running("ui-test", 40*time.Minute)}, now)
+	require.Empty(t, slow)
+	require.Empty(t, hung)
+}
+
+func Test_handleSlowBuilds(t *testing.T) {
+	var abortedPaths []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		abortedPaths = append(abortedPaths, r.URL.Path)
+	}))
+	defer server.Close()
+
+	hung := []slowBuild{{Slug: "slug", Workflow: "ui-test", Running: 31 * time.Minute, Limit: 30 * time.Minute, P90: 10 * time.Minute}}
+	newRouter := func(action string) (*router, *recordingSink) {
+		sink := &recordingSink{}
+		r := &router{
+			app:    bitrise.App{BaseURL: server.URL, Slug: "app", AccessToken: "token", IsDebugRetryTimings: true},
+			cfg:    Config{HungBuildAction: action},
+			state:  &routerState{Builds: []*routedBuild{{Workflow: "ui-test", Slug: "slug"}}},
+			events: &eventBus{},
+		}
+		r.events.subscribe(sink)
+		return r, sink
+	}
+
+	r, sink := newRouter(hungBuildActionAbort)
+	require.NoError(t, r.handleSlowBuilds(nil, hung))
+	require.Equal(t, []string{"/v0.1/apps/app/builds/slug/abort"}, abortedPaths)
+	require.Len(t, sink.events, 2)
+	require.Equal(t, eventTimedOut, sink.events[0].Type)
+	require.Equal(t, eventAborted, sink.events[1].Type)
+
+	abortedPaths = nil
+	r, sink = newRouter(hungBuildActionFail)
+	require.EqualError(t, r.handleSlowBuilds(nil, hung), "build of ui-test is hung: "+hung[0].String())
+	require.Empty(t, abortedPaths)
+	require.Len(t, sink.events, 1)
+}
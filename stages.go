@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// parseStages parses the stages input, a stage per line with comma separated workflows.
+// If the stages input is empty, every workflow of the workflows input is in a single stage.
+func parseStages(stagesInput, workflowsInput string) [][]string {
+	if len(splitLines(stagesInput)) == 0 {
+		if workflows := splitLines(workflowsInput); len(workflows) > 0 {
+			return [][]string{workflows}
+		}
+		return nil
+	}
+
+	var stages [][]string
+	for _, line := range splitLines(stagesInput) {
+		var stage []string
+		for _, wf := range strings.Split(line, ",") {
+			if wf = strings.TrimSpace(wf); wf != "" {
+				stage = append(stage, wf)
+			}
+		}
+		if len(stage) > 0 {
+			stages = append(stages, stage)
+		}
+	}
+	return stages
+}
+
+func flattenStages(stages [][]string) []string {
+	var workflows []string
+	for _, stage := range stages {
+		workflows = append(workflows, stage...)
+	}
+	return workflows
+}
+
+// filterStages keeps the selected workflows of the stages, dropping the stages left empty.
+func filterStages(stages [][]string, selected []string) [][]string {
+	var filtered [][]string
+	for _, stage := range stages {
+		var workflows []string
+		for _, wf := range stage {
+			if contains(selected, wf) {
+				workflows = append(workflows, wf)
+			}
+		}
+		if len(workflows) > 0 {
+			filtered = append(filtered, workflows)
+		}
+	}
+	return filtered
+}
+
+// runStages starts the stages one after the other, waiting for each stage to pass before starting the next one.
+// The workflows of the stages after a failed stage are skipped.
+func (r *router) runStages(stages [][]string) error {
+	offset := 0
+	for i, stage := range stages {
+		fmt.Println()
+		log.Infof("Stage %d/%d: %s", i+1, len(stages), strings.Join(stage, ", "))
+
+		buildSlugs, err := r.startStage(i+1, offset, stage)
+		if err != nil {
+			return err
+		}
+		offset += len(stage)
+		if err := r.exportStartedBuilds(); err != nil {
+			return err
+		}
+
+		fmt.Println()
+		log.Infof("Waiting for stage %d builds:", i+1)
+
+		if err := r.waitForAllBuilds(buildSlugs); err != nil {
+			for _, skippedStage := range stages[i+1:] {
+				for _, wf := range skippedStage {
+					r.state.Skipped = append(r.state.Skipped, skippedWorkflow{Workflow: wf, Reason: fmt.Sprintf("stage %d failed", i+1)})
+				}
+			}
+			r.saveState()
+			return fmt.Errorf("stage %d failed: %s", i+1, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bitrise-steplib/bitrise-step-build-router-start/bitrise"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_parseStages(t *testing.T) {
+	require.Equal(t, [][]string{{"lint", "unit"}, {"ui"}}, parseStages(" lint, unit \n\n ui,\n", "ignored"))
+	require.Equal(t, [][]string{{"lint", "unit"}}, parseStages("", "lint\nunit\n"))
+	require.Nil(t, parseStages("", ""))
+}
+
+func Test_filterStages(t *testing.T) {
+	stages := [][]string{{"lint", "unit"}, {"ui"}, {"deploy"}}
+	require.Equal(t, [][]string{{"unit"}, {"deploy"}}, filterStages(stages, []string{"unit", "deploy"}))
+	require.Equal(t, []string{"lint", "unit", "ui", "deploy"}, flattenStages(stages))
+}
+
+// stubEnvman puts a no-op envman on the PATH, so the envs can be exported in tests.
+func stubEnvman(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "envman"), []byte("#!/bin/sh\n"), 0755))
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func Test_runStages(t *testing.T) {
+	stubEnvman(t)
+
+	var startedWorkflows []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			body, err := ioutil.ReadAll(r.Body)
+			require.NoError(t, err)
+
+			var request struct {
+				BuildParams struct {
+					WorkflowID string `json:"workflow_id"`
+				} `json:"build_params"`
+			}
+			require.NoError(t, json.Unmarshal(body, &request))
+
+			wf := request.BuildParams.WorkflowID
+			startedWorkflows = append(startedWorkflows, wf)
+			fmt.Fprintf(w, `{"status": "ok", "build_slug": "%s-slug", "triggered_workflow": "%s"}`, wf, wf)
+			return
+		}
+
+		slug := path.Base(r.URL.Path)
+		status := 1
+		if slug == "ui-slug" {
+			status = 2
+		}
+		fmt.Fprintf(w, `{"data": {"slug": "%s", "status": %d, "status_text": "finished", "triggered_workflow": "%s"}}`, slug, status, slug[:len(slug)-5])
+	}))
+	defer server.Close()
+
+	stages := [][]string{{"lint", "unit"}, {"ui"}, {"deploy"}}
+	r := router{
+		app:               bitrise.App{BaseURL: server.URL, Slug: "app", AccessToken: "token", IsDebugRetryTimings: true, PollInterval: time.Millisecond},
+		events:            &eventBus{},
+		state:             newRouterState("", "parent", flattenStages(stages)),
+		parentBuildParams: json.RawMessage(`{"branch": "main"}`),
+		workflowEnvs:      map[string][]bitrise.Environment{},
+	}
+
+	err := r.runStages(stages)
+	require.EqualError(t, err, "stage 2 failed: 1 build failed or aborted: ui (ui-slug) error")
+	require.Equal(t, []string{"lint", "unit", "ui"}, startedWorkflows)
+	require.Equal(t, []skippedWorkflow{{Workflow: "deploy", Reason: "stage 2 failed"}}, r.state.Skipped)
+
+	require.Len(t, r.state.Builds, 3)
+	require.Equal(t, 1, r.state.Builds[1].Stage)
+	require.Equal(t, 2, r.state.Builds[2].Stage)
+	require.Equal(t, "UI", r.state.Builds[2].EnvKey)
+}
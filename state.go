@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// skippedWorkflow is a workflow the Step didn't start because of its condition or the changed files rules.
+type skippedWorkflow struct {
+	Workflow string `json:"workflow"`
+	Reason   string `json:"reason"`
+}
+
+// routerState is persisted after every change, so a retried Step can resume waiting for the builds it already started.
+type routerState struct {
+	ParentBuildSlug string         `json:"parent_build_slug"`
+	Workflows       []string       `json:"workflows"`
+	Builds          []*routedBuild `json:"builds"`
+	// Skipped lists the workflows of the workflows input which were not started.
+	Skipped []skippedWorkflow `json:"skipped,omitempty"`
+
+	path string
+}
+
+func newRouterState(pth, parentBuildSlug string, workflows []string) *routerState {
+	return &routerState{
+		ParentBuildSlug: parentBuildSlug,
+		Workflows:       workflows,
+		path:            pth,
+	}
+}
+
+// defaultStatePath returns the state file path used when the state_file_path input is empty.
+func defaultStatePath(parentBuildSlug string) string {
+	return filepath.Join(os.TempDir(), "bitrise-build-router-start", parentBuildSlug+".json")
+}
+
+// loadRouterState reads the state file, it returns nil if the file does not exist.
+func loadRouterState(pth string) (*routerState, error) {
+	b, err := ioutil.ReadFile(pth)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var state routerState
+	if err := json.Unmarshal(b, &state); err != nil {
+		return nil, fmt.Errorf("failed to parse state file (%s): %s", pth, err)
+	}
+	state.path = pth
+	return &state, nil
+}
+
+// canResume checks if the state was written by the same parent build, for the same workflows.
+func (s *routerState) canResume(parentBuildSlug string, workflows []string) bool {
+	if s.ParentBuildSlug != parentBuildSlug || len(s.Workflows) != len(workflows) {
+		return false
+	}
+	for i, wf := range workflows {
+		if s.Workflows[i] != wf {
+			return false
+		}
+	}
+	return len(s.Builds) <= len(workflows)
+}
+
+func (s *routerState) findBuild(buildSlug string) *routedBuild {
+	for _, b := range s.Builds {
+		if b.Slug == buildSlug {
+			return b
+		}
+	}
+	return nil
+}
+
+func (s *routerState) buildSlugs() []string {
+	var slugs []string
+	for _, b := range s.Builds {
+		slugs = append(slugs, b.Slug)
+	}
+	return slugs
+}
+
+// save writes the state file, the file is replaced atomically to survive a crash during the write.
+func (s *routerState) save() error {
+	if s.path == "" {
+		return nil
+	}
+
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return err
+	}
+
+	tmpPth := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmpPth, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPth, s.path)
+}
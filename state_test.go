@@ -0,0 +1,45 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/bitrise-steplib/bitrise-step-build-router-start/bitrise"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_routerState_saveAndLoad(t *testing.T) {
+	pth := filepath.Join(t.TempDir(), "state", "router.json")
+
+	loaded, err := loadRouterState(pth)
+	require.NoError(t, err)
+	require.Nil(t, loaded)
+
+	state := newRouterState(pth, "parent", []string{"wf1", "wf2"})
+	state.Builds = append(state.Builds, &routedBuild{
+		Workflow:            "wf1",
+		EnvKey:              "WF1",
+		Slug:                "slug1",
+		BuildNumber:         12,
+		URL:                 "https://app.bitrise.io/build/slug1",
+		Attempt:             1,
+		Status:              bitrise.BuildStatusSuccessful,
+		DownloadedArtifacts: []string{"app.ipa"},
+	})
+	require.NoError(t, state.save())
+
+	loaded, err = loadRouterState(pth)
+	require.NoError(t, err)
+	require.Equal(t, state, loaded)
+	require.True(t, loaded.findBuild("slug1").isArtifactDownloaded("app.ipa"))
+	require.Nil(t, loaded.findBuild("slug2"))
+}
+
+func Test_routerState_canResume(t *testing.T) {
+	state := newRouterState("", "parent", []string{"wf1", "wf2"})
+
+	require.True(t, state.canResume("parent", []string{"wf1", "wf2"}))
+	require.False(t, state.canResume("other", []string{"wf1", "wf2"}))
+	require.False(t, state.canResume("parent", []string{"wf1"}))
+	require.False(t, state.canResume("parent", []string{"wf2", "wf1"}))
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/bitrise-io/go-utils/log"
+	"github.com/bitrise-steplib/bitrise-step-build-router-start/bitrise"
+)
+
+const (
+	summaryMarkdownFileName = "build-router-summary.md"
+	summaryHTMLFileName     = "build-router-summary.html"
+	summaryLogTailLines     = 30
+)
+
+const skippedIcon = "⏭️"
+
+var ansiEscapeRegexp = regexp.MustCompile(`\x1b\[[0-9;]*[A-Za-z]`)
+
+var statusIcons = map[bitrise.BuildStatus]string{
+	bitrise.BuildStatusRunning:            "⏳",
+	bitrise.BuildStatusSuccessful:         "✅",
+	bitrise.BuildStatusFailed:             "❌",
+	bitrise.BuildStatusAborted:            "⛔",
+	bitrise.BuildStatusAbortedWithSuccess: "☑️",
+}
+
+func statusIcon(status bitrise.BuildStatus) string {
+	if icon, ok := statusIcons[status]; ok {
+		return icon
+	}
+	return "❔"
+}
+
+// summaryRow is a routed build in the summary report.
+type summaryRow struct {
+	Icon      string
+	Workflow  string
+	URL       string
+	Status    string
+	Duration  string
+	Artifacts []string
+	// LogTail is the end of the build log, only set for failed builds.
+	LogTail string
+}
+
+func newSummaryRows(builds []*routedBuild, logTails map[string]string) []summaryRow {
+	var rows []summaryRow
+	for _, b := range builds {
+		duration := "-"
+		if d := b.duration(); d > 0 {
+			duration = d.Round(time.Second).String()
+		}
+
+		status := b.Status.String()
+		if b.Reused {
+			status += " (reused)"
+		}
+
+		rows = append(rows, summaryRow{
+			Icon:      statusIcon(b.Status),
+			Workflow:  b.Workflow,
+			URL:       b.URL,
+			Status:    status,
+			Duration:  duration,
+			Artifacts: b.DownloadedArtifacts,
+			LogTail:   logTails[b.Slug],
+		})
+	}
+	return rows
+}
+
+// tailLines returns the last n lines of the text, without ANSI color codes.
+func tailLines(text string, n int) string {
+	lines := strings.Split(strings.TrimRight(ansiEscapeRegexp.ReplaceAllString(text, ""), "\n"), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, "\n")
+}
+
+func escapeMarkdownCell(s string) string {
+	return strings.NewReplacer("|", `\|`, "\n", " ").Replace(s)
+}
+
+func renderMarkdownSummary(rows []summaryRow, skipped []skippedWorkflow) string {
+	var b strings.Builder
+	b.WriteString("# Started builds\n\n")
+	b.WriteString("| | Workflow | Status | Duration | Artifacts |\n")
+	b.WriteString("|---|---|---|---|---|\n")
+	for _, row := range rows {
+		fmt.Fprintf(&b, "| %s | [%s](%s) | %s | %s | %s |\n",
+			row.Icon,
+			escapeMarkdownCell(row.Workflow),
+			row.URL,
+			row.Status,
+			row.Duration,
+			escapeMarkdownCell(strings.Join(row.Artifacts, ", ")),
+		)
+	}
+
+	if len(skipped) > 0 {
+		b.WriteString("\n## Skipped workflows\n\n")
+		for _, wf := range skipped {
+			fmt.Fprintf(&b, "- %s %s: %s\n", skippedIcon, wf.Workflow, wf.Reason)
+		}
+	}
+
+	for _, row := range rows {
+		if row.LogTail == "" {
+			continue
+		}
+		fmt.Fprintf(&b, "\n## %s %s log\n\n```\n%s\n```\n", row.Icon, row.Workflow, strings.Replace(row.LogTail, "```", "'''", -1))
+	}
+	return b.String()
+}
+
+var htmlSummaryTemplate = template.Must(template.New("summary").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Started builds</title>
+<style>
+body { font-family: -apple-system, BlinkMacSystemFont, "Segoe UI", Helvetica, Arial, sans-serif; margin: 2em; color: #2b0e3f; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #ddd; padding: 6px 12px; text-align: left; vertical-align: top; }
+th { background: #f4f4f4; }
+pre { background: #2b0e3f; color: #f4f4f4; padding: 8px; margin: 0; overflow-x: auto; max-width: 960px; }
+</style>
+</head>
+<body>
+<h1>Started builds</h1>
+<table>
+<tr><th></th><th>Workflow</th><th>Status</th><th>Duration</th><th>Artifacts</th></tr>
+{{- range .Rows }}
+<tr><td>{{ .Icon }}</td><td><a href="{{ .URL }}">{{ .Workflow }}</a></td><td>{{ .Status }}</td><td>{{ .Duration }}</td><td>{{ range $i, $a := .Artifacts }}{{ if $i }}<br>{{ end }}{{ $a }}{{ end }}</td></tr>
+{{- if .LogTail }}
+<tr><td></td><td colspan="4"><pre>{{ .LogTail }}</pre></td></tr>
+{{- end }}
+{{- end }}
+</table>
+{{- if .Skipped }}
+<h2>Skipped workflows</h2>
+<table>
+<tr><th></th><th>Workflow</th><th>Reason</th></tr>
+{{- range .Skipped }}
+<tr><td>{{ $.SkippedIcon }}</td><td>{{ .Workflow }}</td><td>{{ .Reason }}</td></tr>
+{{- end }}
+</table>
+{{- end }}
+</body>
+</html>
+`))
+
+func renderHTMLSummary(rows []summaryRow, skipped []skippedWorkflow) (string, error) {
+	data := struct {
+		Rows        []summaryRow
+		Skipped     []skippedWorkflow
+		SkippedIcon string
+	}{rows, skipped, skippedIcon}
+
+	var buf bytes.Buffer
+	if err := htmlSummaryTemplate.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// writeSummary writes the Markdown and HTML summary of the routed builds into the given directory.
+func (r *router) writeSummary(dir string) error {
+	logTails := map[string]string{}
+	for _, b := range r.state.Builds {
+		if !b.Status.IsFailure() {
+			continue
+		}
+
+		buildLog, err := r.app.GetBuildLog(b.Slug)
+		if err != nil {
+			log.Warnf("Failed to get log of %s: %s", b.Workflow, err)
+			continue
+		}
+		text, err := buildLog.Text(r.app)
+		if err != nil {
+			log.Warnf("Failed to get log of %s: %s", b.Workflow, err)
+			continue
+		}
+		logTails[b.Slug] = tailLines(text, summaryLogTailLines)
+	}
+
+	rows := newSummaryRows(r.state.Builds, logTails)
+	html, err := renderHTMLSummary(rows, r.state.Skipped)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for name, content := range map[string]string{
+		summaryMarkdownFileName: renderMarkdownSummary(rows, r.state.Skipped),
+		summaryHTMLFileName:     html,
+	} {
+		pth := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(pth, []byte(content), 0644); err != nil {
+			return err
+		}
+		log.Donef("Summary written to %s", pth)
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bitrise-steplib/bitrise-step-build-router-start/bitrise"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_tailLines(t *testing.T) {
+	require.Equal(t, "c\nd", tailLines("a\nb\nc\nd\n", 2))
+	require.Equal(t, "a", tailLines("a", 2))
+	require.Equal(t, "red", tailLines("\x1b[31;1mred\x1b[0m", 2))
+}
+
+func Test_renderSummary(t *testing.T) {
+	started := time.Date(2020, 1, 1, 10, 0, 0, 0, time.UTC)
+	finished := started.Add(90 * time.Second)
+	builds := []*routedBuild{
+		{Workflow: "ui|test", Slug: "slug-1", URL: buildURL("", "slug-1"), Status: bitrise.BuildStatusSuccessful, StartedAt: &started, FinishedAt: &finished, DownloadedArtifacts: []string{"app.apk", "report.html"}},
+		{Workflow: "unit", Slug: "slug-2", URL: buildURL("", "slug-2"), Status: bitrise.BuildStatusFailed},
+	}
+	rows := newSummaryRows(builds, map[string]string{"slug-2": "<fail> tests failed"})
+
+	skipped := []skippedWorkflow{{Workflow: "deploy", Reason: "condition is false: is_tag"}}
+
+	markdown := renderMarkdownSummary(rows, skipped)
+	require.Contains(t, markdown, "| ✅ | [ui\\|test](https://app.bitrise.io/build/slug-1) | success | 1m30s | app.apk, report.html |")
+	require.Contains(t, markdown, "| ❌ | [unit](https://app.bitrise.io/build/slug-2) | error | - |  |")
+	require.Contains(t, markdown, "## ❌ unit log\n\n```\n<fail> tests failed\n```")
+
+	require.Contains(t, markdown, "## Skipped workflows\n\n- ⏭️ deploy: condition is false: is_tag\n")
+
+	html, err := renderHTMLSummary(rows, skipped)
+	require.NoError(t, err)
+	require.Contains(t, html, `<a href="https://app.bitrise.io/build/slug-1">ui|test</a>`)
+	require.Contains(t, html, "app.apk<br>report.html")
+	require.Contains(t, html, "<pre>&lt;fail&gt; tests failed</pre>")
+	require.Contains(t, html, "<tr><td>⏭️</td><td>deploy</td><td>condition is false: is_tag</td></tr>")
+}
+
+func Test_writeSummary(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/v0.1/apps/app-slug/builds/slug-2/log", r.URL.Path)
+		_, err := w.Write([]byte(`{"log_chunks":[{"chunk":"line 2\n","position":1},{"chunk":"line 1\n","position":0}]}`))
+		require.NoError(t, err)
+	}))
+	defer server.Close()
+
+	r := &router{
+		app: bitrise.App{BaseURL: server.URL, Slug: "app-slug", AccessToken: "token"},
+		state: &routerState{Builds: []*routedBuild{
+			{Workflow: "ui", Slug: "slug-1", Status: bitrise.BuildStatusSuccessful},
+			{Workflow: "unit", Slug: "slug-2", Status: bitrise.BuildStatusFailed},
+		}},
+	}
+
+	dir := t.TempDir()
+	require.NoError(t, r.writeSummary(dir))
+
+	markdown, err := ioutil.ReadFile(filepath.Join(dir, summaryMarkdownFileName))
+	require.NoError(t, err)
+	require.True(t, strings.Contains(string(markdown), "```\nline 1\nline 2\n```"), string(markdown))
+
+	_, err = ioutil.ReadFile(filepath.Join(dir, summaryHTMLFileName))
+	require.NoError(t, err)
+}
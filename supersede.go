@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/bitrise-io/go-utils/log"
+	"github.com/bitrise-steplib/bitrise-step-build-router-start/bitrise"
+)
+
+// supersededBuildsLimit is the number of running builds of the branch checked for superseded builds.
+const supersededBuildsLimit = 50
+
+// buildOrigin is the part of the original build params identifying where a build comes from.
+type buildOrigin struct {
+	Branch        string
+	PullRequestID string
+	// SourceBuildSlug is the slug of the parent build which started the build, empty if it was not started by the Step.
+	SourceBuildSlug string
+}
+
+func parseBuildOrigin(buildParams json.RawMessage) buildOrigin {
+	var params struct {
+		Branch        string                `json:"branch"`
+		PullRequestID json.Number           `json:"pull_request_id"`
+		Environments  []bitrise.Environment `json:"environments"`
+	}
+	if err := json.Unmarshal(buildParams, &params); err != nil {
+		log.Debugf("Failed to parse build params: %s", err)
+	}
+
+	origin := buildOrigin{Branch: params.Branch, PullRequestID: params.PullRequestID.String()}
+	for _, env := range params.Environments {
+		if env.MappedTo == bitrise.SourceBuildSlugEnvKey {
+			origin.SourceBuildSlug = env.Value
+		}
+	}
+	return origin
+}
+
+func (o buildOrigin) sameBranch(other buildOrigin) bool {
+	return o.Branch == other.Branch && o.PullRequestID == other.PullRequestID
+}
+
+// supersededBuilds returns the running builds which were started by an earlier run of the Step, in a parent build
+// of the same workflow, for the same branch or pull request as the parent build.
+// Builds started by the parent of the parent build (if the parent build was started by the Step too) are kept.
+func supersededBuilds(app bitrise.App, parent bitrise.Build, running []bitrise.Build) ([]bitrise.Build, error) {
+	parentOrigin := parseBuildOrigin(parent.OriginalBuildParams)
+	ownSourceBuildSlug := os.Getenv(bitrise.SourceBuildSlugEnvKey)
+
+	sourceBuilds := map[string]bitrise.Build{}
+	var superseded []bitrise.Build
+	for _, build := range running {
+		if build.Slug == parent.Slug || !build.IsRunning() {
+			continue
+		}
+
+		origin := parseBuildOrigin(build.OriginalBuildParams)
+		if origin.SourceBuildSlug == "" || origin.SourceBuildSlug == parent.Slug || origin.SourceBuildSlug == ownSourceBuildSlug {
+			continue
+		}
+		if !origin.sameBranch(parentOrigin) {
+			continue
+		}
+
+		source, ok := sourceBuilds[origin.SourceBuildSlug]
+		if !ok {
+			var err error
+			if source, err = app.GetBuild(origin.SourceBuildSlug); err != nil {
+				return nil, fmt.Errorf("failed to get parent build (%s) of %s: %s", origin.SourceBuildSlug, build.Slug, err)
+			}
+			sourceBuilds[origin.SourceBuildSlug] = source
+		}
+		if source.TriggeredWorkflow != parent.TriggeredWorkflow || source.BuildNumber >= parent.BuildNumber {
+			continue
+		}
+
+		superseded = append(superseded, build)
+	}
+	return superseded, nil
+}
+
+// cancelSupersededBuilds aborts the builds started by earlier parent builds of the same branch or pull request.
+func (r *router) cancelSupersededBuilds(parent bitrise.Build) error {
+	origin := parseBuildOrigin(parent.OriginalBuildParams)
+	runningStatus := bitrise.BuildStatusRunning
+	response, err := r.app.ListBuilds(bitrise.ListBuildsParams{Branch: origin.Branch, Status: &runningStatus, Limit: supersededBuildsLimit})
+	if err != nil {
+		return fmt.Errorf("failed to list running builds: %s", err)
+	}
+
+	superseded, err := supersededBuilds(r.app, parent, response.Builds)
+	if err != nil {
+		return err
+	}
+	if len(superseded) == 0 {
+		log.Printf("No superseded builds found")
+		fmt.Println()
+		return nil
+	}
+
+	log.Infof("Aborting superseded builds:")
+	for _, build := range superseded {
+		abortReason := fmt.Sprintf("Superseded by build #%s [%s]\nAuto aborted by parent build", r.cfg.BuildNumber, r.parentBuildURL())
+		if err := r.app.AbortBuild(build.Slug, abortReason); err != nil {
+			log.Warnf("failed to abort build, error: %s", err)
+			continue
+		}
+		log.Donef("- %s #%d aborted (%s)", build.TriggeredWorkflow, build.BuildNumber, r.buildURL(build.Slug))
+
+		r.events.publish(newEvent(eventAborted, routedBuild{
+			Workflow:    build.TriggeredWorkflow,
+			Slug:        build.Slug,
+			BuildNumber: build.BuildNumber,
+			URL:         r.buildURL(build.Slug),
+			Status:      build.Status,
+		}, abortReason))
+	}
+	fmt.Println()
+	return nil
+}
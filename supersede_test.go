@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bitrise-steplib/bitrise-step-build-router-start/bitrise"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_parseBuildOrigin(t *testing.T) {
+	origin := parseBuildOrigin([]byte(`{"branch": "feature", "pull_request_id": 12, "environments": [{"mapped_to": "SOURCE_BITRISE_BUILD_SLUG", "value": "parent"}]}`))
+	require.Equal(t, buildOrigin{Branch: "feature", PullRequestID: "12", SourceBuildSlug: "parent"}, origin)
+
+	require.Equal(t, buildOrigin{Branch: "main"}, parseBuildOrigin([]byte(`{"branch": "main"}`)))
+}
+
+func Test_cancelSupersededBuilds(t *testing.T) {
+	t.Setenv(bitrise.SourceBuildSlugEnvKey, "")
+
+	childParams := func(branch, sourceBuildSlug string) string {
+		return fmt.Sprintf(`{"branch": %q, "environments": [{"mapped_to": "SOURCE_BITRISE_BUILD_SLUG", "value": %q}]}`, branch, sourceBuildSlug)
+	}
+	running := []string{
+		// started by an earlier run of the same workflow
+		fmt.Sprintf(`{"slug": "old-child", "status": 0, "build_number": 5, "triggered_workflow": "ui-test", "original_build_params": %s}`, childParams("feature", "old-parent")),
+		// started by this run
+		fmt.Sprintf(`{"slug": "own-child", "status": 0, "build_number": 11, "triggered_workflow": "ui-test", "original_build_params": %s}`, childParams("feature", "parent")),
+		// started by a later run
+		fmt.Sprintf(`{"slug": "new-child", "status": 0, "build_number": 13, "triggered_workflow": "ui-test", "original_build_params": %s}`, childParams("feature", "new-parent")),
+		// started by a run of another workflow
+		fmt.Sprintf(`{"slug": "other-child", "status": 0, "build_number": 6, "triggered_workflow": "lint", "original_build_params": %s}`, childParams("feature", "other-parent")),
+		// not started by the Step
+		`{"slug": "old-parent", "status": 0, "build_number": 4, "triggered_workflow": "primary", "original_build_params": {"branch": "feature"}}`,
+	}
+
+	var aborted []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v0.1/apps/app/builds":
+			require.Equal(t, "feature", r.URL.Query().Get("branch"))
+			require.Equal(t, "0", r.URL.Query().Get("status"))
+			fmt.Fprintf(w, `{"data": [%s, %s, %s, %s, %s]}`, running[0], running[1], running[2], running[3], running[4])
+		case "/v0.1/apps/app/builds/old-parent":
+			fmt.Fprint(w, `{"data": {"slug": "old-parent", "build_number": 4, "triggered_workflow": "primary"}}`)
+		case "/v0.1/apps/app/builds/new-parent":
+			fmt.Fprint(w, `{"data": {"slug": "new-parent", "build_number": 12, "triggered_workflow": "primary"}}`)
+		case "/v0.1/apps/app/builds/other-parent":
+			fmt.Fprint(w, `{"data": {"slug": "other-parent", "build_number": 3, "triggered_workflow": "deploy"}}`)
+		case "/v0.1/apps/app/builds/old-child/abort":
+			aborted = append(aborted, "old-child")
+			fmt.Fprint(w, `{"status": "ok"}`)
+		default:
+			t.Errorf("unexpected request: %s", r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	sink := &recordingSink{}
+	r := router{
+		app:    bitrise.App{BaseURL: server.URL, Slug: "app", AccessToken: "token", IsDebugRetryTimings: true},
+		cfg:    Config{BuildSlug: "parent", BuildNumber: "10"},
+		events: &eventBus{},
+	}
+	r.events.subscribe(sink)
+
+	parent := bitrise.Build{Slug: "parent", BuildNumber: 10, TriggeredWorkflow: "primary", OriginalBuildParams: []byte(`{"branch": "feature"}`)}
+	require.NoError(t, r.cancelSupersededBuilds(parent))
+
+	require.Equal(t, []string{"old-child"}, aborted)
+	require.Len(t, sink.events, 1)
+	require.Equal(t, eventAborted, sink.events[0].Type)
+	require.Equal(t, "old-child", sink.events[0].BuildSlug)
+}
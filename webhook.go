@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/bitrise-steplib/bitrise-step-build-router-start/bitrise"
+	"github.com/hashicorp/go-retryablehttp"
+)
+
+const (
+	webhookOnCompletion = "completion"
+	webhookOnFailure    = "failure"
+	webhookOnBoth       = "both"
+)
+
+// webhookBuild is a routed build in the webhook payload.
+type webhookBuild struct {
+	Workflow string `json:"workflow"`
+	Slug     string `json:"build_slug"`
+	Number   int64  `json:"build_number"`
+	URL      string `json:"build_url"`
+	Status   string `json:"status"`
+	// Duration is the duration of the build in seconds, 0 if the build is not finished.
+	Duration float64 `json:"duration"`
+}
+
+// webhookPayload is the default webhook body and the data of the custom body templates.
+// The text field makes the default body compatible with Slack incoming webhooks.
+type webhookPayload struct {
+	Text              string         `json:"text"`
+	Event             string         `json:"event"`
+	Success           bool           `json:"success"`
+	ParentBuildNumber string         `json:"parent_build_number"`
+	ParentBuildURL    string         `json:"parent_build_url"`
+	Builds            []webhookBuild `json:"builds"`
+}
+
+// webhookNotifier sends the webhooks when a build fails (as an event sink) or when all the builds finish.
+// The state has to be set before the builds are started.
+type webhookNotifier struct {
+	urls              []string
+	on                string
+	template          *template.Template
+	client            *retryablehttp.Client
+	state             *routerState
+	parentBuildNumber string
+	parentBuildURL    string
+}
+
+func parseWebhookTemplate(text string) (*template.Template, error) {
+	if strings.TrimSpace(text) == "" {
+		return nil, nil
+	}
+	return template.New("webhook").Funcs(template.FuncMap{
+		"json": func(v interface{}) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		},
+	}).Parse(text)
+}
+
+func newWebhookPayload(event, parentBuildNumber, parentBuildURL string, builds []*routedBuild) webhookPayload {
+	payload := webhookPayload{
+		Event:             event,
+		Success:           true,
+		ParentBuildNumber: parentBuildNumber,
+		ParentBuildURL:    parentBuildURL,
+	}
+
+	lines := []string{fmt.Sprintf("Builds started by <%s|#%s> %s:", parentBuildURL, parentBuildNumber, event)}
+	for _, b := range builds {
+		if !b.Status.IsSuccess() {
+			payload.Success = false
+		}
+		payload.Builds = append(payload.Builds, webhookBuild{
+			Workflow: b.Workflow,
+			Slug:     b.Slug,
+			Number:   b.BuildNumber,
+			URL:      b.URL,
+			Status:   b.Status.String(),
+			Duration: b.duration().Seconds(),
+		})
+		lines = append(lines, fmt.Sprintf("- <%s|%s> %s (%s)", b.URL, b.Workflow, b.Status, b.duration().Round(time.Second)))
+	}
+	payload.Text = strings.Join(lines, "\n")
+	return payload
+}
+
+func (n *webhookNotifier) body(payload webhookPayload) ([]byte, error) {
+	if n.template == nil {
+		return json.Marshal(payload)
+	}
+
+	var buf bytes.Buffer
+	if err := n.template.Execute(&buf, payload); err != nil {
+		return nil, fmt.Errorf("failed to execute webhook template: %s", err)
+	}
+	if !json.Valid(buf.Bytes()) {
+		return nil, fmt.Errorf("webhook template produced invalid JSON: %s", buf.String())
+	}
+	return buf.Bytes(), nil
+}
+
+func (n *webhookNotifier) send(payload webhookPayload) error {
+	body, err := n.body(payload)
+	if err != nil {
+		return err
+	}
+
+	var errs []string
+	for i, webhookURL := range n.urls {
+		if err := n.post(webhookURL, body); err != nil {
+			errs = append(errs, fmt.Sprintf("webhook #%d: %s", i+1, err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to send webhook: %s", strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+// post sends the body to the webhook URL, the returned errors don't contain the URL, as it is a credential.
+func (n *webhookNotifier) post(webhookURL string, body []byte) error {
+	req, err := retryablehttp.NewRequest(http.MethodPost, webhookURL, body)
+	if err != nil {
+		return withoutURL(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return withoutURL(err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("webhook responded with statuscode: %d, body: %s", resp.StatusCode, respBody)
+	}
+	return nil
+}
+
+// withoutURL strips the request URL from the errors of the HTTP client.
+func withoutURL(err error) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return fmt.Errorf("%s request failed: %s", urlErr.Op, urlErr.Err)
+	}
+	return err
+}
+
+// newWebhookClient returns a retryable client without a logger, as the retry logs contain the webhook URLs.
+func newWebhookClient(app bitrise.App) *retryablehttp.Client {
+	client := app.NewRetryableClient()
+	client.Logger = nil
+	return client
+}
+
+// handle sends a webhook for each build which fails the Step, if enabled.
+func (n *webhookNotifier) handle(e event) error {
+	if n.on == webhookOnCompletion || e.Type != eventFailed {
+		return nil
+	}
+
+	build := n.state.findBuild(e.BuildSlug)
+	if build == nil {
+		return nil
+	}
+	return n.send(newWebhookPayload("failed", n.parentBuildNumber, n.parentBuildURL, []*routedBuild{build}))
+}
+
+// notifyCompletion sends a webhook listing every routed build, if enabled.
+func (n *webhookNotifier) notifyCompletion() error {
+	if n.on == webhookOnFailure {
+		return nil
+	}
+	return n.send(newWebhookPayload("finished", n.parentBuildNumber, n.parentBuildURL, n.state.Builds))
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bitrise-io/go-steputils/stepconf"
+	"github.com/bitrise-steplib/bitrise-step-build-router-start/bitrise"
+	"github.com/stretchr/testify/require"
+)
+
+func testWebhookState() *routerState {
+	started := time.Date(2022, 1, 1, 10, 0, 0, 0, time.UTC)
+	finished := started.Add(90 * time.Second)
+
+	state := newRouterState("", "parent", []string{"unit-test", "ui-test"})
+	state.Builds = []*routedBuild{
+		{Workflow: "unit-test", Slug: "slug1", BuildNumber: 11, URL: "https://app.bitrise.io/build/slug1", Status: bitrise.BuildStatusSuccessful, StartedAt: &started, FinishedAt: &finished},
+		{Workflow: "ui-test", Slug: "slug2", BuildNumber: 12, URL: "https://app.bitrise.io/build/slug2", Status: bitrise.BuildStatusFailed, StartedAt: &started, FinishedAt: &finished},
+	}
+	return state
+}
+
+func newTestWebhookReceiver(t *testing.T, failures int) (*httptest.Server, *[][]byte) {
+	var bodies [][]byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		require.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		body, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		bodies = append(bodies, body)
+	}))
+	return server, &bodies
+}
+
+func newTestWebhookNotifier(url, on, tmpl string, state *routerState) (*webhookNotifier, error) {
+	r := router{
+		app: bitrise.App{IsDebugRetryTimings: true},
+		cfg: Config{BuildSlug: "parent", BuildNumber: "10", WebhookURLs: stepconf.Secret(url), WebhookOn: on, WebhookTemplate: tmpl},
+	}
+	notifier, err := r.newWebhookNotifier()
+	if notifier != nil {
+		notifier.state = state
+	}
+	return notifier, err
+}
+
+func Test_webhookNotifier_notifyCompletion(t *testing.T) {
+	server, bodies := newTestWebhookReceiver(t, 1)
+	defer server.Close()
+
+	notifier, err := newTestWebhookNotifier(server.URL, webhookOnCompletion, "", testWebhookState())
+	require.NoError(t, err)
+	require.NoError(t, notifier.notifyCompletion())
+	require.Len(t, *bodies, 1)
+
+	var payload webhookPayload
+	require.NoError(t, json.Unmarshal((*bodies)[0], &payload))
+	require.Equal(t, webhookPayload{
+		Text:              "Builds started by <https://app.bitrise.io/build/parent|#10> finished:\n- <https://app.bitrise.io/build/slug1|unit-test> success (1m30s)\n- <https://app.bitrise.io/build/slug2|ui-test> error (1m30s)",
+		Event:             "finished",
+		Success:           false,
+		ParentBuildNumber: "10",
+		ParentBuildURL:    "https://app.bitrise.io/build/parent",
+		Builds: []webhookBuild{
+			{Workflow: "unit-test", Slug: "slug1", Number: 11, URL: "https://app.bitrise.io/build/slug1", Status: "success", Duration: 90},
+			{Workflow: "ui-test", Slug: "slug2", Number: 12, URL: "https://app.bitrise.io/build/slug2", Status: "error", Duration: 90},
+		},
+	}, payload)
+
+	// Failure notifications are disabled
+	require.NoError(t, notifier.handle(newEvent(eventFailed, *testWebhookState().Builds[1], "")))
+	require.Len(t, *bodies, 1)
+}
+
+func Test_webhookNotifier_failure(t *testing.T) {
+	server, bodies := newTestWebhookReceiver(t, 0)
+	defer server.Close()
+
+	tmpl := `{"text": {{ json (printf "%s %s" .Event (index .Builds 0).Workflow) }}, "ok": {{ .Success }}}`
+	notifier, err := newTestWebhookNotifier(server.URL, webhookOnFailure, tmpl, testWebhookState())
+	require.NoError(t, err)
+
+	state := testWebhookState()
+	require.NoError(t, notifier.handle(newEvent(eventFinished, *state.Builds[0], "")))
+	require.NoError(t, notifier.handle(newEvent(eventStatusChanged, *state.Builds[1], "")))
+	require.NoError(t, notifier.handle(newEvent(eventFinished, *state.Builds[1], "")))
+	require.NoError(t, notifier.handle(newEvent(eventFailed, *state.Builds[1], "")))
+	require.NoError(t, notifier.notifyCompletion())
+
+	require.Len(t, *bodies, 1)
+	require.JSONEq(t, `{"text": "failed ui-test", "ok": false}`, string((*bodies)[0]))
+}
+
+func Test_webhookNotifier_errors(t *testing.T) {
+	notifier, err := newTestWebhookNotifier("", webhookOnBoth, "", nil)
+	require.NoError(t, err)
+	require.Nil(t, notifier)
+
+	_, err = newTestWebhookNotifier("http://localhost", webhookOnBoth, "{{ .Missing", nil)
+	require.Error(t, err)
+
+	server, bodies := newTestWebhookReceiver(t, 100)
+	defer server.Close()
+
+	notifier, err = newTestWebhookNotifier(server.URL, webhookOnBoth, `{"text": {{ .Text }}}`, testWebhookState())
+	require.NoError(t, err)
+	require.Error(t, notifier.notifyCompletion())
+
+	notifier, err = newTestWebhookNotifier(server.URL, webhookOnBoth, "", testWebhookState())
+	require.NoError(t, err)
+	require.Error(t, notifier.notifyCompletion())
+	require.Len(t, *bodies, 0)
+}
+
+func Test_webhookNotifier_errorsHideURL(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	webhookURL := server.URL + "/services/secret-token"
+	server.Close()
+
+	notifier, err := newTestWebhookNotifier(webhookURL, webhookOnCompletion, "", testWebhookState())
+	require.NoError(t, err)
+	require.Nil(t, notifier.client.Logger)
+
+	err = notifier.notifyCompletion()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "webhook #1: Post request failed")
+	require.NotContains(t, err.Error(), "secret-token")
+	require.NotContains(t, err.Error(), server.URL)
+}
+
+func Test_router_waitAndReport(t *testing.T) {
+	server, bodies := newTestWebhookReceiver(t, 0)
+	defer server.Close()
+
+	notifier, err := newTestWebhookNotifier(server.URL, webhookOnCompletion, "", nil)
+	require.NoError(t, err)
+	r := router{events: &eventBus{}, state: testWebhookState()}
+
+	// waiting was interrupted, the builds may still be running
+	err = r.waitAndReport(notifier, func() error { return errors.New("timed out") })
+	require.EqualError(t, err, "timed out")
+	require.Len(t, *bodies, 0)
+
+	failedErr := &bitrise.BuildsFailedError{Failed: []bitrise.BuildResult{{Slug: "slug2", Workflow: "ui-test", Status: bitrise.BuildStatusFailed}}}
+	err = r.waitAndReport(notifier, func() error { return failedErr })
+	require.Equal(t, failedErr, err)
+	require.Len(t, *bodies, 1)
+}